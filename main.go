@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/arangodb/network-blocker/middleware"
 	"github.com/arangodb/network-blocker/service"
@@ -28,6 +29,11 @@ var (
 		Short: "Network helper for testAgent",
 		Run:   cmdMainRun,
 	}
+	cmdCleanup = cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove network-blocker chains & rules left behind on this host",
+		Run:   cmdCleanupRun,
+	}
 	log      = logging.MustGetLogger(projectName)
 	appFlags struct {
 		host string
@@ -35,14 +41,30 @@ var (
 		service.ServiceConfig
 		logLevel string
 	}
+	cleanupFlags struct {
+		all   bool
+		chain string
+	}
 	maskAny = errors.WithStack
 )
 
 func init() {
+	pf := cmdMain.PersistentFlags()
+	pf.StringVar(&appFlags.logLevel, "log-level", "debug", "Minimum log level (debug|info|warning|error)")
+	pf.StringVar(&appFlags.BackendType, "backend", service.BackendIPTables, "Firewall backend used to block traffic (iptables|nftables)")
+	pf.StringVar(&appFlags.TCDevice, "tc-device", "", "Network device via which traffic is shaped by shaping rules such as delay (optional)")
+
 	f := cmdMain.Flags()
 	f.StringVar(&appFlags.host, "host", "0.0.0.0", "Host address to listen on")
 	f.IntVar(&appFlags.port, "port", 8086, "Port to listen on")
-	f.StringVar(&appFlags.logLevel, "log-level", "debug", "Minimum log level (debug|info|warning|error)")
+	f.StringVar(&appFlags.Orphans, "orphans", service.OrphansDelete, "What to do with chains left behind by previous instances (delete|adopt)")
+	f.StringVar(&appFlags.StateFile, "state-file", "", "Path of a file used to persist rules across restarts (optional)")
+	f.DurationVar(&appFlags.OperationTimeout, "operation-timeout", 30*time.Second, "Maximum time spent retrying a single firewall operation (0 means no limit)")
+	f.DurationVar(&appFlags.ReconcileInterval, "reconcile-interval", 10*time.Second, "Interval at which rules are checked for drift (0 disables)")
+
+	cf := cmdCleanup.Flags()
+	cf.BoolVar(&cleanupFlags.all, "all", false, "Remove the chains of all network-blocker instances")
+	cf.StringVar(&cleanupFlags.chain, "chain", "", "Remove the chains of the network-blocker instance with given chain name (NETBLK-<id>)")
 }
 
 // handleSignal listens for termination signals and stops this process onup termination.
@@ -59,15 +81,21 @@ func handleSignal(sigChannel chan os.Signal, stopChan chan struct{}) {
 }
 
 func main() {
+	cmdMain.AddCommand(&cmdCleanup)
 	cmdMain.Execute()
 }
 
-func cmdMainRun(cmd *cobra.Command, args []string) {
+// setLogLevel configures the logger with the level given by the log-level flag.
+func setLogLevel() {
 	level, err := logging.LogLevel(appFlags.logLevel)
 	if err != nil {
 		Exitf("Invalid log-level '%s': %#v", appFlags.logLevel, err)
 	}
 	logging.SetLevel(level, projectName)
+}
+
+func cmdMainRun(cmd *cobra.Command, args []string) {
+	setLogLevel()
 
 	// Interrupt signal:
 	sigChannel := make(chan os.Signal)
@@ -113,6 +141,20 @@ func cmdMainRun(cmd *cobra.Command, args []string) {
 	log.Infof("%s terminated", projectName)
 }
 
+func cmdCleanupRun(cmd *cobra.Command, args []string) {
+	setLogLevel()
+	if cleanupFlags.all == (cleanupFlags.chain != "") {
+		Exitf("Specify either --all or --chain")
+	}
+
+	if err := service.RemoveChains(appFlags.ServiceConfig, service.ServiceDependencies{
+		Logger: log,
+	}, cleanupFlags.chain); err != nil {
+		Exitf("Cleanup failed: %#v", err)
+	}
+	log.Info("Cleanup done")
+}
+
 // getEnvVar returns the value of the environment variable with given key of the given default
 // value of no such variable exist or is empty.
 func getEnvVar(key, defaultValue string) string {
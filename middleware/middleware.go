@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"encoding/json"
 	"net/http"
 
 	logging "github.com/op/go-logging"
@@ -18,12 +19,24 @@ func SetupRoutes(log *logging.Logger, s *service.Service) http.Handler {
 	m.Get("/ping", handlePing)
 	m.Group("/api/v1", func() {
 		m.Get("/rules", handleRules)
-		m.Post("/drop/tcp/:port", handleTcpDrop)
-		m.Post("/reject/tcp/:port", handleTcpReject)
-		m.Post("/accept/tcp/:port", handleTcpAccept)
-		m.Post("/drop/from", handleAllFromDrop)
-		m.Post("/reject/from", handleAllFromReject)
-		m.Post("/accept/from", handleAllFromAccept)
+		m.Post("/rules", handleRuleApply)
+		m.Delete("/rules", handleRulesRemove)
+		m.Post("/rules/batch", handleRuleBatchApply)
+		m.Get("/sets", handleRuleSets)
+		m.Put("/sets/:name", handleRuleSetPut)
+		m.Delete("/sets/:name", handleRuleSetDelete)
+		m.Post("/sets/:name/activate", handleRuleSetActivate)
+		m.Post("/sets/:name/deactivate", handleRuleSetDeactivate)
+		m.Get("/leases", handleLeases)
+		m.Post("/leases", handleLeaseCreate)
+		m.Post("/leases/:id/heartbeat", handleLeaseHeartbeat)
+		m.Delete("/leases/:id", handleLeaseRelease)
+		m.Get("/drift", handleDrift)
+		for _, e := range ruleEndpoints {
+			for _, match := range e.matches {
+				m.Post("/"+string(e.action)+"/"+match, handleRule(e.action, ruleMatches[match]))
+			}
+		}
 	})
 
 	return m
@@ -33,72 +46,314 @@ func handlePing(ctx *macaron.Context) {
 	ctx.PlainText(200, []byte("OK"))
 }
 
-func handleTcpDrop(ctx *macaron.Context, s *service.Service) {
-	port := ctx.ParamsInt("port")
-	if err := s.DropTCP(port); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+// allMatches contains all match kinds of rule endpoints.
+var allMatches = []string{"tcp/:port", "udp/:port", "from", "to"}
+
+// ruleEndpoints lists the actions that have rule endpoints (`/<action>/<match>`),
+// with the match kinds they support.
+var ruleEndpoints = []struct {
+	action  service.Action
+	matches []string
+}{
+	{service.ActionDrop, allMatches},
+	{service.ActionReject, allMatches},
+	{service.ActionAccept, allMatches},
+	{service.ActionLoss, []string{"tcp/:port", "udp/:port", "from"}},
+	{service.ActionDelay, allMatches},
+	{service.ActionThrottle, allMatches},
+	{service.ActionCorrupt, allMatches},
+	{service.ActionDuplicate, allMatches},
+	{service.ActionReorder, allMatches},
+}
+
+// ruleMatches maps the match kinds of rule endpoints to the function that parses the match of a rule
+// from a request to such an endpoint.
+var ruleMatches = map[string]func(ctx *macaron.Context, rule *service.Rule) error{
+	"tcp/:port": parsePortMatch("tcp"),
+	"udp/:port": parsePortMatch("udp"),
+	"from":      parseFromMatch,
+	"to":        parseToMatch,
+}
+
+// handleRule returns a handler that applies a rule with the given action,
+// matching the traffic parsed by the given function.
+func handleRule(action service.Action, parseMatch func(ctx *macaron.Context, rule *service.Rule) error) macaron.Handler {
+	return func(ctx *macaron.Context, s *service.Service) {
+		rule := service.Rule{Action: action}
+		if err := parseMatch(ctx, &rule); err != nil {
+			sendError(ctx, errorStatusCode(err), err)
+		} else if err := parseRuleParams(ctx, &rule); err != nil {
+			sendError(ctx, errorStatusCode(err), err)
+		} else if err := s.ApplyRule(ctx.Req.Request.Context(), rule); err != nil {
+			sendError(ctx, errorStatusCode(err), err)
+		} else {
+			sendOK(ctx)
+		}
+	}
+}
+
+func handleRules(ctx *macaron.Context, s *service.Service) {
+	labels, err := service.ParseLabels(ctx.QueryStrings("label"))
+	if err != nil {
+		sendError(ctx, errorStatusCode(err), err)
+		return
+	}
+	data := map[string]interface{}{
+		"rules": s.RulesWithLabels(labels),
+	}
+	ctx.JSON(http.StatusOK, data)
+}
+
+func handleRulesRemove(ctx *macaron.Context, s *service.Service) {
+	if labels, err := service.ParseLabels(ctx.QueryStrings("label")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
+	} else if removed, err := s.RemoveRulesWithLabels(ctx.Req.Request.Context(), labels); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
+	} else {
+		data := map[string]interface{}{
+			"status":  "ok",
+			"removed": removed,
+		}
+		ctx.JSON(http.StatusOK, data)
+	}
+}
+
+func handleRuleApply(ctx *macaron.Context, s *service.Service) {
+	var rule service.Rule
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&rule); err != nil {
+		sendError(ctx, http.StatusBadRequest, err)
+	} else if err := s.ApplyRule(ctx.Req.Request.Context(), rule); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
 		sendOK(ctx)
 	}
 }
 
-func handleTcpReject(ctx *macaron.Context, s *service.Service) {
-	port := ctx.ParamsInt("port")
-	if err := s.RejectTCP(port); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+func handleRuleBatchApply(ctx *macaron.Context, s *service.Service) {
+	var batch struct {
+		Rules []service.Rule `json:"rules"`
+	}
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&batch); err != nil {
+		sendError(ctx, http.StatusBadRequest, err)
+	} else if err := s.ApplyRules(ctx.Req.Request.Context(), batch.Rules); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
 		sendOK(ctx)
 	}
 }
 
-func handleTcpAccept(ctx *macaron.Context, s *service.Service) {
-	port := ctx.ParamsInt("port")
-	if err := s.AcceptTCP(port); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+func handleRuleSets(ctx *macaron.Context, s *service.Service) {
+	data := map[string]interface{}{
+		"sets": s.RuleSets(),
+	}
+	ctx.JSON(http.StatusOK, data)
+}
+
+func handleRuleSetPut(ctx *macaron.Context, s *service.Service) {
+	var set struct {
+		Rules []service.Rule `json:"rules"`
+	}
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&set); err != nil {
+		sendError(ctx, http.StatusBadRequest, err)
+	} else if err := s.PutRuleSet(ctx.Req.Request.Context(), ctx.Params("name"), set.Rules); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
 		sendOK(ctx)
 	}
 }
 
-func handleAllFromDrop(ctx *macaron.Context, s *service.Service) {
-	ip := ctx.Query("ip")
-	intf := ctx.Query("intf")
-	if err := s.DropAllFrom(ip, intf); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+func handleRuleSetDelete(ctx *macaron.Context, s *service.Service) {
+	if err := s.DeleteRuleSet(ctx.Req.Request.Context(), ctx.Params("name")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
 		sendOK(ctx)
 	}
 }
 
-func handleAllFromReject(ctx *macaron.Context, s *service.Service) {
-	ip := ctx.Query("ip")
-	intf := ctx.Query("intf")
-	if err := s.RejectAllFrom(ip, intf); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+func handleRuleSetActivate(ctx *macaron.Context, s *service.Service) {
+	if err := s.ActivateRuleSet(ctx.Req.Request.Context(), ctx.Params("name")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
 		sendOK(ctx)
 	}
 }
 
-func handleAllFromAccept(ctx *macaron.Context, s *service.Service) {
-	ip := ctx.Query("ip")
-	intf := ctx.Query("intf")
-	if err := s.AcceptAllFrom(ip, intf); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+func handleRuleSetDeactivate(ctx *macaron.Context, s *service.Service) {
+	if err := s.DeactivateRuleSet(ctx.Req.Request.Context(), ctx.Params("name")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
 		sendOK(ctx)
 	}
 }
 
-func handleRules(ctx *macaron.Context, s *service.Service) {
-	if list, err := s.Rules(); err != nil {
-		sendError(ctx, http.StatusInternalServerError, err)
+func handleLeases(ctx *macaron.Context, s *service.Service) {
+	data := map[string]interface{}{
+		"leases": s.Leases(),
+	}
+	ctx.JSON(http.StatusOK, data)
+}
+
+func handleDrift(ctx *macaron.Context, s *service.Service) {
+	data := map[string]interface{}{
+		"events": s.DriftEvents(),
+	}
+	ctx.JSON(http.StatusOK, data)
+}
+
+func handleLeaseCreate(ctx *macaron.Context, s *service.Service) {
+	if timeout, err := service.ParseDuration(ctx.Query("timeout")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
+	} else if lease, err := s.CreateLease(timeout); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
 	} else {
-		data := map[string]interface{}{
-			"rules": list,
+		ctx.JSON(http.StatusOK, lease)
+	}
+}
+
+func handleLeaseHeartbeat(ctx *macaron.Context, s *service.Service) {
+	if lease, err := s.RenewLease(ctx.Params("id")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
+	} else {
+		ctx.JSON(http.StatusOK, lease)
+	}
+}
+
+func handleLeaseRelease(ctx *macaron.Context, s *service.Service) {
+	if err := s.ReleaseLease(ctx.Req.Request.Context(), ctx.Params("id")); err != nil {
+		sendError(ctx, errorStatusCode(err), err)
+	} else {
+		sendOK(ctx)
+	}
+}
+
+// parsePortMatch returns a function that parses the `port` parameter & `direction` query parameter of a request
+// into a rule matching the given protocol.
+func parsePortMatch(protocol string) func(ctx *macaron.Context, rule *service.Rule) error {
+	return func(ctx *macaron.Context, rule *service.Rule) error {
+		ports, err := service.ParsePorts(ctx.Params("port"))
+		if err != nil {
+			return err
 		}
-		ctx.JSON(http.StatusOK, data)
+		dir, err := service.ParseDirection(ctx.Query("direction"))
+		if err != nil {
+			return err
+		}
+		rule.Protocol = protocol
+		rule.DestinationPorts = ports
+		rule.Direction = dir
+		return nil
+	}
+}
+
+// parseFromMatch parses the `ip`, `intf` & `direction` query parameters of a request
+// into a rule matching the traffic coming from the given address.
+func parseFromMatch(ctx *macaron.Context, rule *service.Rule) error {
+	dir, err := service.ParseDirection(ctx.Query("direction"))
+	if err != nil {
+		return err
+	}
+	rule.Source = ctx.Query("ip")
+	rule.InInterface = ctx.Query("intf")
+	rule.Direction = dir
+	return nil
+}
+
+// parseToMatch parses the `ip`, `intf` & `direction` query parameters of a request
+// into a rule matching the traffic going to the given address.
+func parseToMatch(ctx *macaron.Context, rule *service.Rule) error {
+	dir, err := service.ParseDirection(ctx.Query("direction"))
+	if err != nil {
+		return err
+	}
+	rule.Destination = ctx.Query("ip")
+	rule.OutInterface = ctx.Query("intf")
+	rule.Direction = dir
+	return nil
+}
+
+// parseRuleParams parses the query parameters of a request that contain the parameters of the action of the given rule
+// (`with`, `percent`, `mode`, shaping parameters) and its options.
+func parseRuleParams(ctx *macaron.Context, rule *service.Rule) error {
+	switch rule.Action {
+	case service.ActionAccept:
+		// Accept rules have no parameters, nor options
+		return nil
+	case service.ActionReject:
+		rule.RejectWith = ctx.Query("with")
+	case service.ActionLoss, service.ActionCorrupt, service.ActionDuplicate, service.ActionReorder:
+		percent, err := service.ParsePercent(ctx.Query("percent"))
+		if err != nil {
+			return err
+		}
+		rule.Percent = percent
+		if rule.Action == service.ActionLoss {
+			rule.Mode = service.LossMode(ctx.Query("mode"))
+		}
+	}
+	switch rule.Action {
+	case service.ActionDelay, service.ActionThrottle, service.ActionReorder:
+		shaping, err := parseShaping(ctx)
+		if err != nil {
+			return err
+		}
+		rule.Shaping = shaping
+	}
+	opts, err := parseRuleOptions(ctx)
+	if err != nil {
+		return err
+	}
+	rule.RuleOptions = opts
+	return nil
+}
+
+// parseRuleOptions parses the query parameters of a request that contain rule options (`ttl`, `lease`).
+func parseRuleOptions(ctx *macaron.Context) (service.RuleOptions, error) {
+	ttl, err := service.ParseDuration(ctx.Query("ttl"))
+	if err != nil {
+		return service.RuleOptions{}, err
+	}
+	labels, err := service.ParseLabels(ctx.QueryStrings("label"))
+	if err != nil {
+		return service.RuleOptions{}, err
+	}
+	return service.RuleOptions{
+		TTL:    ttl,
+		Lease:  ctx.Query("lease"),
+		Labels: labels,
+	}, nil
+}
+
+// parseShaping parses the query parameters of a request that contain shaping parameters
+// (`delay`, `jitter`, `rate`, `burst`).
+func parseShaping(ctx *macaron.Context) (service.Shaping, error) {
+	delay, err := service.ParseDuration(ctx.Query("delay"))
+	if err != nil {
+		return service.Shaping{}, err
+	}
+	jitter, err := service.ParseDuration(ctx.Query("jitter"))
+	if err != nil {
+		return service.Shaping{}, err
+	}
+	return service.Shaping{
+		Delay:  delay,
+		Jitter: jitter,
+		Rate:   ctx.Query("rate"),
+		Burst:  ctx.Query("burst"),
+	}, nil
+}
+
+// errorStatusCode returns the HTTP status code used to report the given error.
+func errorStatusCode(err error) int {
+	if service.IsValidation(err) {
+		return http.StatusBadRequest
+	}
+	if service.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	if service.IsTimeout(err) {
+		return http.StatusGatewayTimeout
 	}
+	return http.StatusInternalServerError
 }
 
 func sendOK(ctx *macaron.Context) {
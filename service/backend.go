@@ -0,0 +1,210 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BackendIPTables enforces rules using the iptables command.
+	BackendIPTables = "iptables"
+	// BackendNFTables enforces rules using the nft command, in a dedicated inet table.
+	BackendNFTables = "nftables"
+)
+
+// Backend is the firewall mechanism used by a Service to enforce its rules.
+// Rulespecs are expressed in iptables syntax, chains & tables follow iptables naming.
+type Backend interface {
+	// Exists checks if given rulespec in specified table/chain exists
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	// Insert inserts rulespec to specified table/chain (in specified pos)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	// Append appends rulespec to specified table/chain
+	Append(table, chain string, rulespec ...string) error
+	// Delete removes rulespec in specified table/chain
+	Delete(table, chain string, rulespec ...string) error
+	// List rules in specified table/chain
+	List(table, chain string) ([]string, error)
+	// ClearChain flushed (deletes all rules) in the specified table/chain.
+	// If the chain does not exist, a new one will be created
+	ClearChain(table, chain string) error
+	// DeleteChain deletes the chain in the specified table.
+	// The chain must be empty
+	DeleteChain(table, chain string) error
+	// ListChains returns a slice containing the name of each chain in the specified table.
+	ListChains(table string) ([]string, error)
+	// ApplyBatch applies the given changes to rules in a single transaction.
+	// Either all changes are applied, or none.
+	ApplyBatch(changes []RuleChange) error
+}
+
+// builtinChainLister is implemented by backends that keep a copy of every built-in chain for each service,
+// such as the nftables backend, which creates them in the table of the service.
+type builtinChainLister interface {
+	// ListBuiltin lists the rules in the given built-in table/chain of the service with given base chain name (NETBLK-<id>).
+	ListBuiltin(table, chain, base string) ([]string, error)
+}
+
+// listBuiltin lists the rules in the given built-in table/chain that contains the jumps to the chains
+// of the service with given base chain name (NETBLK-<id>).
+func listBuiltin(b Backend, table, chain, base string) ([]string, error) {
+	if l, ok := b.(builtinChainLister); ok {
+		list, err := l.ListBuiltin(table, chain, base)
+		return list, maskAny(err)
+	}
+	list, err := b.List(table, chain)
+	return list, maskAny(err)
+}
+
+// RuleChange is a change to a single rule, applied as part of a batch.
+type RuleChange struct {
+	// Delete is set to remove the rule, otherwise the rule is inserted at the top of the chain
+	Delete bool
+	// Table containing the chain
+	Table string
+	// Chain containing the rule
+	Chain string
+	// RuleSpec of the rule
+	RuleSpec []string
+}
+
+// inverse returns the change that undoes the given change.
+func (c RuleChange) inverse() RuleChange {
+	c.Delete = !c.Delete
+	return c
+}
+
+// invertChanges returns the changes that undo the given changes.
+func invertChanges(changes []RuleChange) []RuleChange {
+	result := make([]RuleChange, 0, len(changes))
+	for i := len(changes) - 1; i >= 0; i-- {
+		result = append(result, changes[i].inverse())
+	}
+	return result
+}
+
+// iptablesBackend is a Backend that uses the iptables (or ip6tables) command.
+// Batches are applied using the iptables-restore (or ip6tables-restore) command.
+type iptablesBackend struct {
+	*iptables.IPTables
+	restoreCommand string
+}
+
+// NewIPTablesBackend creates a Backend that uses the iptables command for IPv4,
+// or the ip6tables command for IPv6.
+func NewIPTablesBackend(family Family) (Backend, error) {
+	proto := iptables.ProtocolIPv4
+	restoreCommand := "iptables-restore"
+	if family == FamilyIPv6 {
+		proto = iptables.ProtocolIPv6
+		restoreCommand = "ip6tables-restore"
+	}
+	client, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return &iptablesBackend{
+		IPTables:       client,
+		restoreCommand: restoreCommand,
+	}, nil
+}
+
+// ApplyBatch applies the given changes to rules in a single transaction,
+// using iptables-restore without flushing existing rules.
+// iptables-restore commits every table on its own, so the changes are applied table by table
+// (preserving their order within each table). If a table fails, the tables committed before are rolled back.
+func (b *iptablesBackend) ApplyBatch(changes []RuleChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	path, err := exec.LookPath(b.restoreCommand)
+	if err != nil {
+		return permanentErrorf("Cannot find %s: %v", b.restoreCommand, err)
+	}
+	var tables []string
+	byTable := make(map[string][]RuleChange)
+	for _, c := range changes {
+		tables = appendUnique(tables, c.Table)
+		byTable[c.Table] = append(byTable[c.Table], c)
+	}
+	for i, table := range tables {
+		if err := b.restore(path, table, byTable[table]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if rollbackErr := b.restore(path, tables[j], invertChanges(byTable[tables[j]])); rollbackErr != nil {
+					return permanentErrorf("%v (rolling back the changes to table '%s' failed: %v)", err, tables[j], rollbackErr)
+				}
+			}
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// restore applies the given changes to rules of the given table in a single transaction,
+// using the iptables-restore command at the given path.
+func (b *iptablesBackend) restore(path, table string, changes []RuleChange) error {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%s\n", table)
+	for _, c := range changes {
+		args := []string{"-I", c.Chain, "1"}
+		if c.Delete {
+			args = []string{"-D", c.Chain}
+		}
+		for _, arg := range append(args, c.RuleSpec...) {
+			if strings.ContainsAny(arg, " \t\"") {
+				arg = strconv.Quote(arg)
+			}
+			input.WriteString(arg + " ")
+		}
+		input.WriteString("\n")
+	}
+	input.WriteString("COMMIT\n")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, "--noflush")
+	cmd.Stdin = &input
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if status, ok := exitStatus(err); ok && status == 4 {
+			// Resource problem, such as a busy xtables lock
+			return maskAny(fmt.Errorf("%s failed: %v: %s", b.restoreCommand, err, msg))
+		}
+		return permanentErrorf("%s failed: %v: %s", b.restoreCommand, err, msg)
+	}
+	return nil
+}
+
+// exitStatus returns the exit status of the process that caused the given error (if any).
+func exitStatus(err error) (int, bool) {
+	if eerr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		if status, ok := eerr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+var (
+	builtinChains = map[string][]string{
+		"filter": {"INPUT", "FORWARD", "OUTPUT"},
+		"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	}
+)
+
+// isBuiltinChain returns true if the given chain is one of the predefined chains of the given table.
+func isBuiltinChain(table, chain string) bool {
+	for _, c := range builtinChains[table] {
+		if c == chain {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"strings"
+)
+
+// ruleBatch collects the changes to the rules of a single client,
+// keeping track of the rules that are present once these changes are applied.
+type ruleBatch struct {
+	client
+	changes []RuleChange
+	present map[string]bool
+}
+
+// newRuleBatch creates an empty batch for the given client.
+func newRuleBatch(c client) *ruleBatch {
+	return &ruleBatch{
+		client:  c,
+		present: make(map[string]bool),
+	}
+}
+
+// ruleKey returns a key that identifies the given rule in the given table/chain.
+func ruleKey(table, chain string, ruleSpec []string) string {
+	return table + " " + chain + " " + strings.Join(ruleSpec, " ")
+}
+
+// isPresent returns true if the given rule is present once the changes collected so far are applied.
+func (b *ruleBatch) isPresent(table, chain string, ruleSpec []string) (bool, error) {
+	key := ruleKey(table, chain, ruleSpec)
+	if present, found := b.present[key]; found {
+		return present, nil
+	}
+	found, err := b.Exists(table, chain, ruleSpec...)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	b.present[key] = found
+	return found, nil
+}
+
+// insert adds the insertion of the given rule to the batch, unless the rule is already present.
+func (b *ruleBatch) insert(table, chain string, ruleSpec []string) error {
+	if present, err := b.isPresent(table, chain, ruleSpec); err != nil {
+		return maskAny(err)
+	} else if !present {
+		b.add(RuleChange{Table: table, Chain: chain, RuleSpec: ruleSpec})
+	}
+	return nil
+}
+
+// delete adds the removal of the given rule to the batch, if the rule is present.
+func (b *ruleBatch) delete(table, chain string, ruleSpec []string) error {
+	if present, err := b.isPresent(table, chain, ruleSpec); err != nil {
+		return maskAny(err)
+	} else if present {
+		b.add(RuleChange{Delete: true, Table: table, Chain: chain, RuleSpec: ruleSpec})
+	}
+	return nil
+}
+
+// add adds the given change to the batch.
+// If the batch already contains a change of the same rule, that change is the inverse
+// of the given change, so both changes cancel each other out.
+func (b *ruleBatch) add(change RuleChange) {
+	key := ruleKey(change.Table, change.Chain, change.RuleSpec)
+	b.present[key] = !change.Delete
+	for i := len(b.changes) - 1; i >= 0; i-- {
+		if ruleKey(b.changes[i].Table, b.changes[i].Chain, b.changes[i].RuleSpec) == key {
+			b.changes = append(b.changes[:i], b.changes[i+1:]...)
+			return
+		}
+	}
+	b.changes = append(b.changes, change)
+}
+
+// plannedRule is a rule together with its traffic control class (shaping rules only).
+type plannedRule struct {
+	rule  Rule
+	class int
+}
+
+// classChange is the configuration of a traffic control class, applied as part of a shaping plan.
+type classChange struct {
+	class int
+	qdisc []string
+	// previous is the qdisc spec the class had before (nil for a new class)
+	previous []string
+}
+
+// rulePlan contains the information needed to apply a list of rules,
+// including the traffic control changes of shaping rules.
+type rulePlan struct {
+	// replaced contains, for every rule, the rules with the same match that it replaces or removes
+	replaced [][]plannedRule
+	// classes contains, for every rule, its traffic control class (0 if it is not a shaping rule)
+	classes []int
+	// set contains the classes to configure before the rules are applied
+	set []classChange
+	// removed contains the classes to remove once the rules are applied
+	removed []int
+}
+
+// planRules finds the rules replaced by the given (normalized) list of rules, assigns a traffic control class
+// to every shaping rule and collects the resulting changes to the classes.
+// A shaping rule keeps the class of the shaping rule with the same match that it replaces.
+func (s *Service) planRules(rules []Rule) (*rulePlan, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	plan := &rulePlan{
+		replaced: make([][]plannedRule, len(rules)),
+		classes:  make([]int, len(rules)),
+	}
+	used := make(map[int]bool)
+	// current contains the applied rules by match key, as they are once the rules planned so far are applied
+	current := make(map[string][]plannedRule)
+	for _, r := range s.rules {
+		if r.class > 0 {
+			used[r.class] = true
+		}
+		key := r.Rule.matchKey()
+		current[key] = append(current[key], plannedRule{rule: r.Rule, class: r.class})
+	}
+	for i, rule := range rules {
+		key := rule.matchKey()
+		var replaced, kept []plannedRule
+		for _, p := range current[key] {
+			if rule.covers(p.rule) {
+				replaced = append(replaced, p)
+			} else {
+				kept = append(kept, p)
+			}
+		}
+		plan.replaced[i] = replaced
+
+		class := 0
+		if rule.Action.isShaping() {
+			if s.Shaper == nil {
+				return nil, validationErrorf("Action '%s' requires traffic shaping, which is not configured", rule.Action)
+			}
+			for _, p := range replaced {
+				if p.class > 0 {
+					class = p.class
+				}
+			}
+			if class == 0 {
+				for c := firstShapingClass; c <= lastShapingClass && class == 0; c++ {
+					if !used[c] {
+						class = c
+					}
+				}
+				if class == 0 {
+					return nil, validationErrorf("Too many shaping rules (at most %d)", lastShapingClass-firstShapingClass+1)
+				}
+				used[class] = true
+			}
+			plan.setClass(class, rule.createQdiscSpec(), replaced)
+		}
+		for _, p := range replaced {
+			if p.class > 0 && p.class != class {
+				plan.removed = append(plan.removed, p.class)
+			}
+		}
+		plan.classes[i] = class
+		if rule.Action != ActionAccept {
+			kept = append(kept, plannedRule{rule: rule, class: class})
+		}
+		current[key] = kept
+	}
+	return plan, nil
+}
+
+// addRule adds the changes needed to apply the given (normalized) rule to the batch.
+// A reject or drop rule replaces a rule with another deny action,
+// an accept rule removes all deny rules with the same match.
+// The given replaced rules are the rules with the same match that are replaced by the given rule,
+// class is the traffic control class of the given rule (if it is a shaping rule).
+func (s *Service) addRule(b *ruleBatch, rule Rule, replaced []plannedRule, class int) error {
+	for _, target := range rule.Action.otherDenyTargets() {
+		ruleSpec := rule.createRuleSpec(b.family, target)
+		for _, h := range rule.Direction.hooks() {
+			if err := b.delete(h.table, h.chainName(s.chainName), ruleSpec); err != nil {
+				return maskAny(err)
+			}
+		}
+	}
+	for _, p := range replaced {
+		ruleSpec := p.rule.createActionSpec(b.family, p.class)
+		for _, h := range p.rule.hooks() {
+			if err := b.delete(h.table, h.chainName(s.chainName), ruleSpec); err != nil {
+				return maskAny(err)
+			}
+		}
+	}
+	if rule.Action == ActionAccept {
+		s.Logger.Infof("Accepting %s traffic %s", b.family, rule)
+		return nil
+	}
+	ruleSpec := rule.createActionSpec(b.family, class)
+	for _, h := range rule.hooks() {
+		chain := h.chainName(s.chainName)
+		if rule.Action.isShaping() {
+			s.Logger.Infof("Shaping %s traffic %s with %s in %s", b.family, rule, strings.Join(rule.createQdiscSpec(), " "), chain)
+		} else if rule.Action == ActionLoss {
+			s.Logger.Infof("Dropping %v%% (%s) of %s traffic %s in %s", rule.Percent, rule.Mode, b.family, rule, chain)
+		} else {
+			s.Logger.Infof("Denying %s traffic %s in %s", b.family, rule, chain)
+		}
+		if err := b.insert(h.table, chain, ruleSpec); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// rollback undoes the changes of the given (applied) batches.
+func (s *Service) rollback(batches []*ruleBatch) {
+	for i := len(batches) - 1; i >= 0; i-- {
+		b := batches[i]
+		if err := b.ApplyBatch(invertChanges(b.changes)); err != nil {
+			s.Logger.Errorf("Failed to roll back %d %s rule changes: %v", len(b.changes), b.family, err)
+		}
+	}
+}
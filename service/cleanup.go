@@ -0,0 +1,67 @@
+package service
+
+import (
+	"sort"
+)
+
+// RemoveChains removes the chains (and the rules that jump to them) of the service instance
+// with given chain name (NETBLK-<id>), or of all service instances if the given chain name is empty.
+// It does not require a running service, so it can be used to cleanup after a crashed instance.
+// If a traffic control device is configured, the root qdisc installed by a service is removed as well.
+func RemoveChains(config ServiceConfig, deps ServiceDependencies, chainName string) error {
+	if chainName != "" {
+		m := serviceChainPattern.FindStringSubmatch(chainName)
+		if m == nil {
+			return maskAny(validationErrorf("Invalid chain name '%s' (expected NETBLK-<id>)", chainName))
+		}
+		chainName = m[1]
+	}
+	clients, err := createClients(config, deps, "NETBLK")
+	if err != nil {
+		return maskAny(err)
+	}
+	for _, c := range clients {
+		found := make(map[string]struct{})
+		for _, table := range serviceTables {
+			chains, err := c.ListChains(table)
+			if err != nil {
+				return maskAny(err)
+			}
+			for _, chain := range chains {
+				if m := serviceChainPattern.FindStringSubmatch(chain); m != nil && (chainName == "" || m[1] == chainName) {
+					found[m[1]] = struct{}{}
+				}
+			}
+		}
+		if len(found) == 0 {
+			deps.Logger.Infof("No %s chains found", c.family)
+			continue
+		}
+		var bases []string
+		for base := range found {
+			bases = append(bases, base)
+		}
+		sort.Strings(bases)
+		for _, base := range bases {
+			deps.Logger.Infof("Removing %s chains of %s", c.family, base)
+			for _, table := range serviceTables {
+				if err := removeChains(c, table, base); err != nil {
+					return maskAny(err)
+				}
+			}
+		}
+	}
+	shaper := deps.Shaper
+	if shaper == nil && config.TCDevice != "" {
+		if shaper, err = NewTCShaper(config.TCDevice); err != nil {
+			return maskAny(err)
+		}
+	}
+	if shaper != nil {
+		deps.Logger.Infof("Removing traffic control qdisc")
+		if err := shaper.Teardown(); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
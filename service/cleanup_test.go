@@ -0,0 +1,48 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	logging "github.com/op/go-logging"
+)
+
+// TestRemoveChains checks that RemoveChains removes the chains (and jumps) of the given service instance only,
+// or of all instances if no chain name is given.
+func TestRemoveChains(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := newOrphan(t, backend)
+	stale := "NETBLK-ffffffff"
+	addStaleChains(t, backend, stale)
+	deps := ServiceDependencies{
+		Logger:  logging.MustGetLogger("test"),
+		Backend: backend,
+	}
+
+	if err := RemoveChains(ServiceConfig{}, deps, "INPUT"); !IsValidation(err) {
+		t.Errorf("Expected validation error, got %v", err)
+	}
+
+	// A chain name with hook suffix selects the service instance it belongs to
+	if err := RemoveChains(ServiceConfig{}, deps, stale+"-IN"); err != nil {
+		t.Fatalf("RemoveChains failed: %v", err)
+	}
+	for _, chain := range serviceChains(t, backend) {
+		if !strings.HasPrefix(chain, s.chainName+"-") {
+			t.Errorf("Expected chain %s to be removed", chain)
+		}
+	}
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.builtin, "-j "+h.chainName(s.chainName))
+	}
+
+	if err := RemoveChains(ServiceConfig{}, deps, ""); err != nil {
+		t.Fatalf("RemoveChains failed: %v", err)
+	}
+	if chains := serviceChains(t, backend); len(chains) != 0 {
+		t.Errorf("Expected no service chains, got %q", chains)
+	}
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.builtin)
+	}
+}
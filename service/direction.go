@@ -0,0 +1,63 @@
+package service
+
+// Direction specifies which traffic a rule applies to.
+type Direction string
+
+const (
+	// DirectionIn applies a rule to traffic received by this host (INPUT hook),
+	// except replies to connections opened by this host
+	DirectionIn Direction = "in"
+	// DirectionOut applies a rule to traffic sent by this host (OUTPUT hook),
+	// except replies to connections opened by its peers
+	DirectionOut Direction = "out"
+	// DirectionBoth applies a rule to all traffic (INPUT, FORWARD & OUTPUT hooks)
+	DirectionBoth Direction = "both"
+)
+
+// hook is a built-in chain that jumps to a chain of the service.
+type hook struct {
+	// Table containing the built-in chain & the chain of the service
+	table string
+	// Name of the built-in chain
+	builtin string
+	// Suffix appended to the chain name of the service
+	suffix string
+}
+
+var (
+	inputHook   = hook{table: filterTable, builtin: "INPUT", suffix: "IN"}
+	forwardHook = hook{table: filterTable, builtin: "FORWARD", suffix: "FWD"}
+	outputHook  = hook{table: filterTable, builtin: "OUTPUT", suffix: "OUT"}
+	allHooks    = []hook{inputHook, forwardHook, outputHook}
+	// markHook marks all traffic sent by this host (or forwarded by it) that has to be shaped
+	markHook = hook{table: mangleTable, builtin: "POSTROUTING", suffix: "MARK"}
+)
+
+// ParseDirection parses the given direction. An empty value results in DirectionBoth.
+func ParseDirection(value string) (Direction, error) {
+	switch Direction(value) {
+	case "", DirectionBoth:
+		return DirectionBoth, nil
+	case DirectionIn, DirectionOut:
+		return Direction(value), nil
+	default:
+		return "", validationErrorf("Invalid direction '%s' (expected in|out|both)", value)
+	}
+}
+
+// hooks returns the hooks that see traffic of this direction.
+func (d Direction) hooks() []hook {
+	switch d {
+	case DirectionIn:
+		return []hook{inputHook}
+	case DirectionOut:
+		return []hook{outputHook}
+	default:
+		return allHooks
+	}
+}
+
+// chainName returns the name of the chain of the service (with given base name) for this hook.
+func (h hook) chainName(base string) string {
+	return base + "-" + h.suffix
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration that is encoded in JSON as a string, e.g. "30s".
+type Duration time.Duration
+
+// ParseDuration parses a duration such as "30s" or "5m".
+// An empty value results in a zero duration.
+func ParseDuration(value string) (Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, validationErrorf("Invalid duration '%s'", value)
+	}
+	return Duration(d), nil
+}
+
+// String returns the duration formatted like time.Duration.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes the duration from a string such as "30s", or from a number of seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil && seconds >= 0 {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return validationErrorf("Invalid duration %s", string(data))
+	}
+	parsed, err := ParseDuration(value)
+	if err != nil {
+		return maskAny(err)
+	}
+	*d = parsed
+	return nil
+}
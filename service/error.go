@@ -1,7 +1,85 @@
 package service
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
 
 var (
 	maskAny = errors.WithStack
 )
+
+// validationError is returned when an argument given to the service is invalid.
+type validationError struct {
+	msg string
+}
+
+func (e validationError) Error() string {
+	return e.msg
+}
+
+// validationErrorf creates a new validation error with a formatted message.
+func validationErrorf(format string, args ...interface{}) error {
+	return maskAny(validationError{msg: fmt.Sprintf(format, args...)})
+}
+
+// IsValidation returns true if the given error is caused by an invalid argument.
+func IsValidation(err error) bool {
+	_, ok := errors.Cause(err).(validationError)
+	return ok
+}
+
+// notFoundError is returned when an object referenced by the caller does not exist.
+type notFoundError struct {
+	msg string
+}
+
+func (e notFoundError) Error() string {
+	return e.msg
+}
+
+// notFoundErrorf creates a new not found error with a formatted message.
+func notFoundErrorf(format string, args ...interface{}) error {
+	return maskAny(notFoundError{msg: fmt.Sprintf(format, args...)})
+}
+
+// IsNotFound returns true if the given error is caused by a reference to an object that does not exist.
+func IsNotFound(err error) bool {
+	_, ok := errors.Cause(err).(notFoundError)
+	return ok
+}
+
+// permanentError is returned by a backend when an operation fails in a way that retrying it does not help.
+type permanentError struct {
+	msg string
+}
+
+func (e permanentError) Error() string {
+	return e.msg
+}
+
+// permanentErrorf creates a new permanent error with a formatted message.
+func permanentErrorf(format string, args ...interface{}) error {
+	return maskAny(permanentError{msg: fmt.Sprintf(format, args...)})
+}
+
+// timeoutError is returned when an operation did not succeed within its deadline.
+type timeoutError struct {
+	msg string
+}
+
+func (e timeoutError) Error() string {
+	return e.msg
+}
+
+// timeoutErrorf creates a new timeout error with a formatted message.
+func timeoutErrorf(format string, args ...interface{}) error {
+	return maskAny(timeoutError{msg: fmt.Sprintf(format, args...)})
+}
+
+// IsTimeout returns true if the given error is caused by an operation that did not succeed within its deadline.
+func IsTimeout(err error) bool {
+	_, ok := errors.Cause(err).(timeoutError)
+	return ok
+}
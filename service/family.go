@@ -0,0 +1,63 @@
+package service
+
+import (
+	"net"
+	"strings"
+)
+
+// Family is a set of IP address families.
+type Family int
+
+const (
+	// FamilyIPv4 is the IPv4 address family
+	FamilyIPv4 Family = 1 << iota
+	// FamilyIPv6 is the IPv6 address family
+	FamilyIPv6
+	// FamilyAll contains both the IPv4 and the IPv6 address family
+	FamilyAll = FamilyIPv4 | FamilyIPv6
+)
+
+// String returns a human readable name of the family.
+func (f Family) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "ipv4"
+	case FamilyIPv6:
+		return "ipv6"
+	case FamilyAll:
+		return "inet"
+	default:
+		return "none"
+	}
+}
+
+// parseAddress parses the given IP address or CIDR range.
+// It returns the address in CIDR notation (a single address gets a /32 or /128 suffix) and its family.
+// An empty address results in an empty string and matches all families.
+func parseAddress(value string) (string, Family, error) {
+	if value == "" {
+		return "", FamilyAll, nil
+	}
+	var ipNet *net.IPNet
+	if strings.Contains(value, "/") {
+		var err error
+		if _, ipNet, err = net.ParseCIDR(value); err != nil {
+			return "", 0, validationErrorf("Invalid CIDR range '%s'", value)
+		}
+	} else {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", 0, validationErrorf("Invalid IP address '%s'", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if ipNet.IP.To4() != nil {
+		return ipNet.String(), FamilyIPv4, nil
+	}
+	return ipNet.String(), FamilyIPv6, nil
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		family   Family
+		err      bool
+	}{
+		{value: "", expected: "", family: FamilyAll},
+		{value: "10.0.0.5", expected: "10.0.0.5/32", family: FamilyIPv4},
+		{value: "10.0.0.0/8", expected: "10.0.0.0/8", family: FamilyIPv4},
+		{value: "10.1.2.3/8", expected: "10.0.0.0/8", family: FamilyIPv4},
+		{value: "::ffff:10.0.0.5", expected: "10.0.0.5/32", family: FamilyIPv4},
+		{value: "fd00::1", expected: "fd00::1/128", family: FamilyIPv6},
+		{value: "fd00::/64", expected: "fd00::/64", family: FamilyIPv6},
+		{value: "10.0.0.256", err: true},
+		{value: "10.0.0.0/33", err: true},
+		{value: "fd00::/129", err: true},
+		{value: "example.com", err: true},
+	}
+	for _, test := range tests {
+		addr, family, err := parseAddress(test.value)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("parseAddress(%q): expected error, got %s", test.value, addr)
+		case test.err && !IsValidation(err):
+			t.Errorf("parseAddress(%q): expected validation error, got %v", test.value, err)
+		case !test.err && err != nil:
+			t.Errorf("parseAddress(%q): unexpected error: %v", test.value, err)
+		case !test.err && (addr != test.expected || family != test.family):
+			t.Errorf("parseAddress(%q): expected %s (%s), got %s (%s)", test.value, test.expected, test.family, addr, family)
+		}
+	}
+}
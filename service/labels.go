@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Labels are key/value pairs attached to a rule by the caller, used to find rules again.
+type Labels map[string]string
+
+// ParseLabels parses the given list of labels, each formatted as `key=value`.
+func ParseLabels(values []string) (Labels, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	result := make(Labels, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, validationErrorf("Invalid label '%s' (expected key=value)", value)
+		}
+		result[parts[0]] = parts[1]
+	}
+	if err := result.validate(); err != nil {
+		return nil, maskAny(err)
+	}
+	return result, nil
+}
+
+// validate returns an error if one of the labels has an invalid key.
+func (l Labels) validate() error {
+	for key := range l {
+		if key == "" || strings.ContainsAny(key, "=, ") {
+			return validationErrorf("Invalid label key '%s'", key)
+		}
+	}
+	return nil
+}
+
+// String returns the labels as comma separated list of key=value pairs, ordered by key.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+l[key])
+	}
+	return strings.Join(parts, ",")
+}
+
+// matches returns true if the labels contain all of the given labels (with the same value).
+func (l Labels) matches(selector Labels) bool {
+	for key, value := range selector {
+		if v, found := l[key]; !found || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// RulesWithLabels returns all rules applied by this service that have all of the given labels,
+// ordered by creation time.
+func (s *Service) RulesWithLabels(selector Labels) []AppliedRule {
+	result := make([]AppliedRule, 0)
+	for _, r := range s.Rules() {
+		if r.Labels.matches(selector) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// RemoveRulesWithLabels removes all rules that have all of the given labels, in a single transaction per backend.
+// Rules with the same match but without these labels are kept.
+// Returns the number of removed rules.
+func (s *Service) RemoveRulesWithLabels(ctx context.Context, selector Labels) (int, error) {
+	if len(selector) == 0 {
+		return 0, validationErrorf("At least one label is required")
+	}
+
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	var rules []Rule
+	for _, r := range s.RulesWithLabels(selector) {
+		rules = append(rules, r.Rule.removalRule())
+	}
+	s.Logger.Infof("Removing %d rules with labels %s", len(rules), selector)
+	before := s.ruleCount()
+	if err := s.applyRules(ctx, rules); err != nil {
+		return 0, maskAny(err)
+	}
+	return before - s.ruleCount(), nil
+}
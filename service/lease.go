@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Lease groups rules created by a single client.
+// The client must renew the lease (heartbeat) before it expires,
+// otherwise all rules created under the lease are removed.
+type Lease struct {
+	// ID of the lease, unique within the service
+	ID string `json:"id"`
+	// Time between heartbeats after which the lease expires
+	Timeout Duration `json:"timeout"`
+	// Time the lease expires unless renewed
+	ExpiresAt time.Time `json:"expires_at"`
+
+	timer *time.Timer
+	// released is set once the lease has ended, until all rules created under it are removed
+	released bool
+}
+
+const (
+	// defaultLeaseTimeout is used for leases created without a timeout
+	defaultLeaseTimeout = Duration(30 * time.Second)
+)
+
+// CreateLease creates a new lease with given timeout (0 means default timeout).
+func (s *Service) CreateLease(timeout Duration) (Lease, error) {
+	if timeout < 0 {
+		return Lease{}, validationErrorf("Invalid lease timeout '%s'", timeout)
+	} else if timeout == 0 {
+		timeout = defaultLeaseTimeout
+	}
+	id, err := createRandomID()
+	if err != nil {
+		return Lease{}, maskAny(err)
+	}
+
+	s.mutex.Lock()
+	lease := &Lease{
+		ID:      id,
+		Timeout: timeout,
+	}
+	s.leases[id] = lease
+	s.renewLease(lease)
+	result := *lease
+	s.mutex.Unlock()
+
+	s.Logger.Infof("Created lease %s with timeout %s", id, timeout)
+	s.saveState()
+	return result, nil
+}
+
+// RenewLease extends the lease with given ID by its timeout.
+func (s *Service) RenewLease(id string) (Lease, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lease, found := s.leases[id]
+	if !found || lease.released {
+		return Lease{}, notFoundErrorf("Lease '%s' not found", id)
+	}
+	s.renewLease(lease)
+	return *lease, nil
+}
+
+// ReleaseLease ends the lease with given ID and removes all rules created under it.
+// If removing the rules fails, the lease is kept (but can no longer be renewed)
+// and removing its rules is retried once its timeout has passed again.
+func (s *Service) ReleaseLease(ctx context.Context, id string) error {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	return maskAny(s.releaseLease(ctx, id, false))
+}
+
+// releaseLease ends the lease with given ID and removes all rules created under it,
+// keeping the rules with the same match that were not created under it.
+// If expiredOnly is set, a lease that has been renewed in the meantime is kept.
+// The mutation mutex must be held.
+func (s *Service) releaseLease(ctx context.Context, id string, expiredOnly bool) error {
+	s.mutex.Lock()
+	lease, found := s.leases[id]
+	if found && expiredOnly && !lease.released && time.Now().Before(lease.ExpiresAt) {
+		// Lease has been renewed while waiting for the mutation mutex
+		s.mutex.Unlock()
+		return nil
+	}
+	if found {
+		lease.timer.Stop()
+		lease.released = true
+	}
+	var rules []Rule
+	for _, r := range s.rules {
+		if r.Lease == id {
+			rules = append(rules, r.Rule)
+		}
+	}
+	s.mutex.Unlock()
+
+	if !found {
+		return notFoundErrorf("Lease '%s' not found", id)
+	}
+	if expiredOnly {
+		s.Logger.Warningf("Lease %s expired", id)
+	}
+	s.Logger.Infof("Releasing lease %s, removing %d rules", id, len(rules))
+	for i := range rules {
+		rules[i] = rules[i].removalRule()
+	}
+	if err := s.applyRules(ctx, rules); err != nil {
+		// Keep the lease until its rules are removed
+		s.mutex.Lock()
+		lease.timer = time.AfterFunc(time.Duration(lease.Timeout), func() { s.expireLease(id) })
+		s.mutex.Unlock()
+		s.Logger.Warningf("Failed to remove rules of lease %s, retrying in %s", id, lease.Timeout)
+		return maskAny(err)
+	}
+	s.mutex.Lock()
+	lease.timer.Stop()
+	delete(s.leases, id)
+	s.mutex.Unlock()
+	s.saveState()
+	return nil
+}
+
+// Leases returns all active leases, ordered by ID.
+func (s *Service) Leases() []Lease {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]string, 0, len(s.leases))
+	for id := range s.leases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := make([]Lease, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, *s.leases[id])
+	}
+	return result
+}
+
+// hasLease returns true if a lease with given ID exists.
+func (s *Service) hasLease(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lease, found := s.leases[id]
+	return found && !lease.released
+}
+
+// renewLease (re)starts the timer of the given lease.
+// The service mutex must be held.
+func (s *Service) renewLease(lease *Lease) {
+	if lease.timer != nil {
+		lease.timer.Stop()
+	}
+	lease.ExpiresAt = time.Now().Add(time.Duration(lease.Timeout))
+	id := lease.ID
+	lease.timer = time.AfterFunc(time.Duration(lease.Timeout), func() { s.expireLease(id) })
+}
+
+// expireLease is called when the lease with given ID has not been renewed in time,
+// or when removing the rules of a released lease has to be retried.
+func (s *Service) expireLease(id string) {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	if err := s.releaseLease(context.Background(), id, true); err != nil && !IsNotFound(err) {
+		s.Logger.Errorf("Failed to release expired lease %s: %v", id, err)
+	}
+}
+
+// stopLeaseTimers stops the timers of all leases.
+func (s *Service) stopLeaseTimers() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, lease := range s.leases {
+		lease.timer.Stop()
+	}
+}
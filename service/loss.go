@@ -0,0 +1,47 @@
+package service
+
+import (
+	"math"
+	"strconv"
+)
+
+// LossMode specifies how the packets dropped by a loss rule are selected.
+type LossMode string
+
+const (
+	// LossRandom drops each matching packet with the probability given by the percentage
+	LossRandom LossMode = "random"
+	// LossNth drops every n-th matching packet, where n follows from the percentage (e.g. 25% drops every 4th packet)
+	LossNth LossMode = "nth"
+)
+
+// validateLoss returns an error if the loss mode does not fit the action of the rule,
+// and fills in the default mode of a loss rule.
+func (r *Rule) validateLoss() error {
+	if r.Action != ActionLoss {
+		if r.Mode != "" {
+			return validationErrorf("Parameter 'mode' is not supported by action '%s'", r.Action)
+		}
+		return nil
+	}
+	switch r.Mode {
+	case "", LossRandom:
+		r.Mode = LossRandom
+	case LossNth:
+		if every := 100 / r.Percent; math.Abs(every-math.Floor(every+0.5)) > 1e-9 {
+			return validationErrorf("Mode '%s' requires a percentage that divides 100 (e.g. 50, 25, 10), got %v", r.Mode, r.Percent)
+		}
+	default:
+		return validationErrorf("Invalid mode '%s' (expected random|nth)", r.Mode)
+	}
+	return nil
+}
+
+// createStatisticSpec returns the rulespec arguments that select the packets dropped by a loss rule.
+func (r Rule) createStatisticSpec() []string {
+	if r.Mode == LossNth {
+		every := int(math.Floor(100/r.Percent + 0.5))
+		return []string{"-m", "statistic", "--mode", "nth", "--every", strconv.Itoa(every), "--packet", "0"}
+	}
+	return []string{"-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(r.Percent/100, 'f', -1, 64)}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLoss(t *testing.T) {
+	tests := []struct {
+		rule     Rule
+		expected LossMode
+		err      bool
+	}{
+		{rule: Rule{Action: ActionLoss, Percent: 10}, expected: LossRandom},
+		{rule: Rule{Action: ActionLoss, Percent: 0.5, Mode: LossRandom}, expected: LossRandom},
+		{rule: Rule{Action: ActionLoss, Percent: 25, Mode: LossNth}, expected: LossNth},
+		{rule: Rule{Action: ActionLoss, Percent: 100, Mode: LossNth}, expected: LossNth},
+		{rule: Rule{Action: ActionLoss, Percent: 30, Mode: LossNth}, err: true},
+		{rule: Rule{Action: ActionLoss, Percent: 10, Mode: "burst"}, err: true},
+		{rule: Rule{Action: ActionDrop}, expected: ""},
+		{rule: Rule{Action: ActionDrop, Mode: LossRandom}, err: true},
+	}
+	for _, test := range tests {
+		rule := test.rule
+		err := rule.validateLoss()
+		switch {
+		case test.err && !IsValidation(err):
+			t.Errorf("validateLoss(%+v): expected validation error, got %v", test.rule, err)
+		case !test.err && err != nil:
+			t.Errorf("validateLoss(%+v): unexpected error: %v", test.rule, err)
+		case !test.err && rule.Mode != test.expected:
+			t.Errorf("validateLoss(%+v): expected mode '%s', got '%s'", test.rule, test.expected, rule.Mode)
+		}
+	}
+}
+
+func TestCreateStatisticSpec(t *testing.T) {
+	tests := []struct {
+		percent  float64
+		mode     LossMode
+		expected string
+	}{
+		{percent: 10, mode: LossRandom, expected: "-m statistic --mode random --probability 0.1"},
+		{percent: 0.5, mode: LossRandom, expected: "-m statistic --mode random --probability 0.005"},
+		{percent: 100, mode: LossRandom, expected: "-m statistic --mode random --probability 1"},
+		{percent: 25, mode: LossNth, expected: "-m statistic --mode nth --every 4 --packet 0"},
+		{percent: 50, mode: LossNth, expected: "-m statistic --mode nth --every 2 --packet 0"},
+		{percent: 100, mode: LossNth, expected: "-m statistic --mode nth --every 1 --packet 0"},
+	}
+	for _, test := range tests {
+		rule := Rule{Action: ActionLoss, Percent: test.percent, Mode: test.mode}
+		if spec := strings.Join(rule.createStatisticSpec(), " "); spec != test.expected {
+			t.Errorf("createStatisticSpec(%v%%, %s): expected %q, got %q", test.percent, test.mode, test.expected, spec)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryBackend is a Backend that keeps all chains & rules in memory.
+// It mimics the behavior of iptables closely enough to run a Service without root privileges,
+// which makes it suitable for tests.
+type MemoryBackend struct {
+	mutex  sync.Mutex
+	tables map[string]map[string][]string
+}
+
+// NewMemoryBackend creates a new, empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{
+		tables: make(map[string]map[string][]string),
+	}
+	for table, chains := range builtinChains {
+		t := make(map[string][]string)
+		for _, chain := range chains {
+			t[chain] = nil
+		}
+		b.tables[table] = t
+	}
+	return b
+}
+
+// Exists checks if given rulespec in specified table/chain exists
+func (b *MemoryBackend) Exists(table, chain string, rulespec ...string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	rules, found := b.chain(table, chain)
+	if !found {
+		return false, nil
+	}
+	return indexOfRule(rules, rulespec) >= 0, nil
+}
+
+// Insert inserts rulespec to specified table/chain (in specified pos)
+func (b *MemoryBackend) Insert(table, chain string, pos int, rulespec ...string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return maskAny(b.insert(table, chain, pos, rulespec))
+}
+
+// insert inserts rulespec to specified table/chain (in specified pos).
+// The mutex must be held.
+func (b *MemoryBackend) insert(table, chain string, pos int, rulespec []string) error {
+	rules, found := b.chain(table, chain)
+	if !found {
+		return permanentErrorf("No chain '%s' in table '%s'", chain, table)
+	}
+	if pos < 1 || pos > len(rules)+1 {
+		return permanentErrorf("Index of insertion too big: %d", pos)
+	}
+	rule := strings.Join(rulespec, " ")
+	rules = append(rules, "")
+	copy(rules[pos:], rules[pos-1:])
+	rules[pos-1] = rule
+	b.tables[table][chain] = rules
+	return nil
+}
+
+// Append appends rulespec to specified table/chain
+func (b *MemoryBackend) Append(table, chain string, rulespec ...string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	rules, found := b.chain(table, chain)
+	if !found {
+		return permanentErrorf("No chain '%s' in table '%s'", chain, table)
+	}
+	b.tables[table][chain] = append(rules, strings.Join(rulespec, " "))
+	return nil
+}
+
+// Delete removes rulespec in specified table/chain
+func (b *MemoryBackend) Delete(table, chain string, rulespec ...string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return maskAny(b.delete(table, chain, rulespec))
+}
+
+// delete removes rulespec in specified table/chain.
+// The mutex must be held.
+func (b *MemoryBackend) delete(table, chain string, rulespec []string) error {
+	rules, found := b.chain(table, chain)
+	if !found {
+		return permanentErrorf("No chain '%s' in table '%s'", chain, table)
+	}
+	idx := indexOfRule(rules, rulespec)
+	if idx < 0 {
+		return permanentErrorf("Bad rule (does a matching rule exist in that chain?)")
+	}
+	b.tables[table][chain] = append(rules[:idx], rules[idx+1:]...)
+	return nil
+}
+
+// List rules in specified table/chain
+func (b *MemoryBackend) List(table, chain string) ([]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	rules, found := b.chain(table, chain)
+	if !found {
+		return nil, permanentErrorf("No chain '%s' in table '%s'", chain, table)
+	}
+	var result []string
+	if isBuiltinChain(table, chain) {
+		result = append(result, fmt.Sprintf("-P %s ACCEPT", chain))
+	} else {
+		result = append(result, fmt.Sprintf("-N %s", chain))
+	}
+	for _, rule := range rules {
+		result = append(result, fmt.Sprintf("-A %s %s", chain, rule))
+	}
+	return result, nil
+}
+
+// ClearChain flushed (deletes all rules) in the specified table/chain.
+// If the chain does not exist, a new one will be created
+func (b *MemoryBackend) ClearChain(table, chain string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	t, found := b.tables[table]
+	if !found {
+		return permanentErrorf("No table '%s'", table)
+	}
+	t[chain] = nil
+	return nil
+}
+
+// DeleteChain deletes the chain in the specified table.
+// The chain must be empty
+func (b *MemoryBackend) DeleteChain(table, chain string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	rules, found := b.chain(table, chain)
+	if !found {
+		return permanentErrorf("No chain '%s' in table '%s'", chain, table)
+	}
+	if isBuiltinChain(table, chain) {
+		return permanentErrorf("Cannot delete built-in chain '%s'", chain)
+	}
+	if len(rules) > 0 {
+		return permanentErrorf("Chain '%s' is not empty", chain)
+	}
+	for _, other := range b.tables[table] {
+		for _, rule := range other {
+			if strings.HasSuffix(rule, "-j "+chain) {
+				return permanentErrorf("Chain '%s' is still referenced", chain)
+			}
+		}
+	}
+	delete(b.tables[table], chain)
+	return nil
+}
+
+// ListChains returns a slice containing the name of each chain in the specified table.
+func (b *MemoryBackend) ListChains(table string) ([]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	t, found := b.tables[table]
+	if !found {
+		return nil, permanentErrorf("No table '%s'", table)
+	}
+	var userChains []string
+	for chain := range t {
+		if !isBuiltinChain(table, chain) {
+			userChains = append(userChains, chain)
+		}
+	}
+	sort.Strings(userChains)
+	return append(append([]string{}, builtinChains[table]...), userChains...), nil
+}
+
+// ApplyBatch applies the given changes to rules in a single transaction.
+// Either all changes are applied, or none.
+func (b *MemoryBackend) ApplyBatch(changes []RuleChange) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Keep a copy of all chains, to restore them on failure
+	original := make(map[string]map[string][]string, len(b.tables))
+	for table, t := range b.tables {
+		chains := make(map[string][]string, len(t))
+		for chain, rules := range t {
+			chains[chain] = append([]string(nil), rules...)
+		}
+		original[table] = chains
+	}
+	for _, c := range changes {
+		var err error
+		if c.Delete {
+			err = b.delete(c.Table, c.Chain, c.RuleSpec)
+		} else {
+			err = b.insert(c.Table, c.Chain, 1, c.RuleSpec)
+		}
+		if err != nil {
+			b.tables = original
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// chain returns the rules of the given table/chain.
+func (b *MemoryBackend) chain(table, chain string) ([]string, bool) {
+	t, found := b.tables[table]
+	if !found {
+		return nil, false
+	}
+	rules, found := t[chain]
+	return rules, found
+}
+
+// indexOfRule returns the index of the given rulespec in the given list of rules or -1 if not found.
+func indexOfRule(rules []string, rulespec []string) int {
+	rule := strings.Join(rulespec, " ")
+	for i, r := range rules {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,546 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NFTablesBackend is a Backend that uses the nft command.
+// All chains & rules of a service are created in an `inet` table of that service:
+// chains named `NETBLK-<id>...` are created in table `netblk-<id>`, built-in chains
+// are created in the table of the chain they jump to (or the default table of the backend).
+// Rulespecs are given in iptables syntax and translated into nftables expressions.
+// The original rulespec is stored as a comment on each rule, which is used to find rules again.
+type NFTablesBackend struct {
+	path  string
+	table string
+}
+
+var (
+	nftRuleLinePattern  = regexp.MustCompile(`comment "([^"]*)" # handle ([0-9]+)$`)
+	nftChainLinePattern = regexp.MustCompile(`^chain (\S+) \{`)
+	nftTableLinePattern = regexp.MustCompile(`^table inet (\S+)`)
+	// nftServiceChainPattern matches the name of chains of a service
+	nftServiceChainPattern = regexp.MustCompile(`^(NETBLK-[0-9a-f]+)`)
+	// nftRejectTypes maps iptables reject types to nftables reject types.
+	// Rules in an inet table use icmpx types, which apply to both IPv4 & IPv6.
+	nftRejectTypes = map[string]string{
+		"tcp-reset":              "tcp reset",
+		"icmp-port-unreachable":  "icmpx type port-unreachable",
+		"icmp6-port-unreachable": "icmpx type port-unreachable",
+		"icmp-host-unreachable":  "icmpx type host-unreachable",
+		"icmp6-addr-unreachable": "icmpx type host-unreachable",
+		"icmp-net-unreachable":   "icmpx type no-route",
+		"icmp6-no-route":         "icmpx type no-route",
+		"icmp-admin-prohibited":  "icmpx type admin-prohibited",
+		"icmp6-adm-prohibited":   "icmpx type admin-prohibited",
+	}
+)
+
+// NewNFTablesBackend creates a Backend that uses the nft command.
+// Built-in chains that do not jump to a chain of a service are created in the `inet` table with given name.
+func NewNFTablesBackend(table string) (Backend, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return &NFTablesBackend{
+		path:  path,
+		table: table,
+	}, nil
+}
+
+// Exists checks if given rulespec in specified table/chain exists
+func (b *NFTablesBackend) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rules, err := b.listRules(b.tableName(chain, rulespec), table, chain)
+	if err != nil {
+		// Like iptables, report a missing chain as a missing rule
+		return false, nil
+	}
+	_, found := rules.find(rulespec)
+	return found, nil
+}
+
+// Insert inserts rulespec to specified table/chain (in specified pos)
+func (b *NFTablesBackend) Insert(table, chain string, pos int, rulespec ...string) error {
+	expr, err := nftRuleExpression(table, rulespec)
+	if err != nil {
+		return maskAny(err)
+	}
+	nftTable := b.tableName(chain, rulespec)
+	if err := b.ensureBuiltinChain(nftTable, table, chain); err != nil {
+		return maskAny(err)
+	}
+	rules, err := b.listRules(nftTable, table, chain)
+	if err != nil {
+		return maskAny(err)
+	}
+	name := nftChainName(table, chain)
+	switch {
+	case pos < 1 || pos > len(rules)+1:
+		return permanentErrorf("Index of insertion too big: %d", pos)
+	case pos == len(rules)+1:
+		return maskAny(b.run(append([]string{"add", "rule", "inet", nftTable, name}, expr...)...))
+	default:
+		return maskAny(b.run(append([]string{"insert", "rule", "inet", nftTable, name, "position", strconv.Itoa(rules[pos-1].handle)}, expr...)...))
+	}
+}
+
+// Append appends rulespec to specified table/chain
+func (b *NFTablesBackend) Append(table, chain string, rulespec ...string) error {
+	expr, err := nftRuleExpression(table, rulespec)
+	if err != nil {
+		return maskAny(err)
+	}
+	nftTable := b.tableName(chain, rulespec)
+	if err := b.ensureBuiltinChain(nftTable, table, chain); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(b.run(append([]string{"add", "rule", "inet", nftTable, nftChainName(table, chain)}, expr...)...))
+}
+
+// Delete removes rulespec in specified table/chain
+func (b *NFTablesBackend) Delete(table, chain string, rulespec ...string) error {
+	nftTable := b.tableName(chain, rulespec)
+	rules, err := b.listRules(nftTable, table, chain)
+	if err != nil {
+		return maskAny(err)
+	}
+	rule, found := rules.find(rulespec)
+	if !found {
+		return permanentErrorf("Bad rule (does a matching rule exist in that chain?)")
+	}
+	return maskAny(b.run("delete", "rule", "inet", nftTable, nftChainName(table, chain), "handle", strconv.Itoa(rule.handle)))
+}
+
+// List rules in specified table/chain.
+// Built-in chains are listed from the default table of the backend, use ListBuiltin to list them from another table.
+func (b *NFTablesBackend) List(table, chain string) ([]string, error) {
+	return b.list(b.tableName(chain, nil), table, chain)
+}
+
+// ListBuiltin lists the rules in the given built-in table/chain of the service with given base chain name (NETBLK-<id>),
+// i.e. the copy of the built-in chain in the nftables table of that service.
+func (b *NFTablesBackend) ListBuiltin(table, chain, base string) ([]string, error) {
+	return b.list(b.tableName(base, nil), table, chain)
+}
+
+// list lists the rules in the given table/chain of the given nftables table.
+// Like in iptables, a missing built-in chain is listed as an empty chain.
+func (b *NFTablesBackend) list(nftTable, table, chain string) ([]string, error) {
+	rules, err := b.listRules(nftTable, table, chain)
+	if err != nil {
+		if !isBuiltinChain(table, chain) {
+			return nil, maskAny(err)
+		}
+		if found, hasErr := b.hasChain(nftTable, nftChainName(table, chain)); hasErr != nil {
+			return nil, maskAny(hasErr)
+		} else if found {
+			return nil, maskAny(err)
+		}
+	}
+	var result []string
+	if isBuiltinChain(table, chain) {
+		result = append(result, fmt.Sprintf("-P %s ACCEPT", chain))
+	} else {
+		result = append(result, fmt.Sprintf("-N %s", chain))
+	}
+	for _, r := range rules {
+		result = append(result, fmt.Sprintf("-A %s %s", chain, r.spec))
+	}
+	return result, nil
+}
+
+// ClearChain flushed (deletes all rules) in the specified table/chain.
+// If the chain does not exist, a new one will be created
+func (b *NFTablesBackend) ClearChain(table, chain string) error {
+	nftTable := b.tableName(chain, nil)
+	if err := b.run("add", "table", "inet", nftTable); err != nil {
+		return maskAny(err)
+	}
+	if err := b.ensureChain(nftTable, table, chain); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(b.run("flush", "chain", "inet", nftTable, nftChainName(table, chain)))
+}
+
+// DeleteChain deletes the chain in the specified table.
+// The chain must be empty.
+// Once the last regular chain is removed, the entire nftables table is removed.
+func (b *NFTablesBackend) DeleteChain(table, chain string) error {
+	nftTable := b.tableName(chain, nil)
+	if err := b.run("delete", "chain", "inet", nftTable, nftChainName(table, chain)); err != nil {
+		return maskAny(err)
+	}
+	output, err := b.output("list", "table", "inet", nftTable)
+	if err != nil {
+		return maskAny(err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "type ") {
+			// Base chain
+			continue
+		}
+		if m := nftChainLinePattern.FindStringSubmatch(line); m != nil && !isBuiltinNFTChain(m[1]) {
+			// There are still regular chains left
+			return nil
+		}
+		if strings.Contains(line, "jump ") {
+			// There are still references left
+			return nil
+		}
+	}
+	return maskAny(b.run("delete", "table", "inet", nftTable))
+}
+
+// ListChains returns a slice containing the name of each chain in the specified table,
+// including the chains in the tables of other services.
+func (b *NFTablesBackend) ListChains(table string) ([]string, error) {
+	output, err := b.output("list", "tables", "inet")
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var nftTables []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if m := nftTableLinePattern.FindStringSubmatch(strings.TrimSpace(scanner.Text())); m != nil {
+			if m[1] == b.table || strings.HasPrefix(m[1], "netblk-") {
+				nftTables = append(nftTables, m[1])
+			}
+		}
+	}
+	result := append([]string{}, builtinChains[table]...)
+	for _, nftTable := range nftTables {
+		output, err := b.output("list", "table", "inet", nftTable)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			m := nftChainLinePattern.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+			if m == nil || isBuiltinNFTChain(m[1]) {
+				continue
+			}
+			if chainTable, chain := parseNFTChainName(m[1]); chainTable == table {
+				result = append(result, chain)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ApplyBatch applies the given changes to rules in a single transaction,
+// by passing them as a single script to nft.
+func (b *NFTablesBackend) ApplyBatch(changes []RuleChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var script bytes.Buffer
+	listed := make(map[string]nftRules)
+	for _, c := range changes {
+		nftTable := b.tableName(c.Chain, c.RuleSpec)
+		name := nftChainName(c.Table, c.Chain)
+		if c.Delete {
+			key := nftTable + " " + name
+			rules, found := listed[key]
+			if !found {
+				var err error
+				if rules, err = b.listRules(nftTable, c.Table, c.Chain); err != nil {
+					return maskAny(err)
+				}
+				listed[key] = rules
+			}
+			rule, found := rules.find(c.RuleSpec)
+			if !found {
+				return permanentErrorf("Bad rule (does a matching rule exist in that chain?)")
+			}
+			fmt.Fprintf(&script, "delete rule inet %s %s handle %d\n", nftTable, name, rule.handle)
+		} else {
+			expr, err := nftRuleExpression(c.Table, c.RuleSpec)
+			if err != nil {
+				return maskAny(err)
+			}
+			fmt.Fprintf(&script, "insert rule inet %s %s %s\n", nftTable, name, strings.Join(expr, " "))
+		}
+	}
+	_, err := b.execute(&script, "-f", "-")
+	return maskAny(err)
+}
+
+// hasChain returns true if the given nftables table exists and contains a chain with given name.
+func (b *NFTablesBackend) hasChain(nftTable, name string) (bool, error) {
+	output, err := b.output("list", "chains", "inet")
+	if err != nil {
+		return false, maskAny(err)
+	}
+	current := ""
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := nftTableLinePattern.FindStringSubmatch(line); m != nil {
+			current = m[1]
+		} else if m := nftChainLinePattern.FindStringSubmatch(line); m != nil && current == nftTable && m[1] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tableName returns the name of the nftables table that contains the given chain.
+// For built-in chains, the target of the given rulespec determines the table.
+func (b *NFTablesBackend) tableName(chain string, rulespec []string) string {
+	name := chain
+	for i, arg := range rulespec {
+		if arg == "-j" && i+1 < len(rulespec) {
+			if m := nftServiceChainPattern.FindStringSubmatch(rulespec[i+1]); m != nil && !nftServiceChainPattern.MatchString(chain) {
+				name = rulespec[i+1]
+			}
+		}
+	}
+	if m := nftServiceChainPattern.FindStringSubmatch(name); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return b.table
+}
+
+// ensureBuiltinChain creates the given nftables table & the base chain for the given built-in chain,
+// if they do not exist yet. Built-in chains exist in every nftables table, just like they exist in iptables.
+// Nothing is done for other chains.
+func (b *NFTablesBackend) ensureBuiltinChain(nftTable, table, chain string) error {
+	if !isBuiltinChain(table, chain) {
+		return nil
+	}
+	if err := b.run("add", "table", "inet", nftTable); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(b.ensureChain(nftTable, table, chain))
+}
+
+// ensureChain creates the given chain if it does not exist yet.
+// Built-in iptables chains are created as base chains hooked into the corresponding netfilter hook.
+func (b *NFTablesBackend) ensureChain(nftTable, table, chain string) error {
+	name := nftChainName(table, chain)
+	if !isBuiltinChain(table, chain) {
+		return maskAny(b.run("add", "chain", "inet", nftTable, name))
+	}
+	priority := 0
+	if table == "mangle" {
+		priority = -150
+	}
+	return maskAny(b.run("add", "chain", "inet", nftTable, name,
+		"{", "type", "filter", "hook", strings.ToLower(chain), "priority", strconv.Itoa(priority), ";", "policy", "accept", ";", "}"))
+}
+
+// nftRule is a rule created by this backend.
+type nftRule struct {
+	spec   string
+	handle int
+}
+
+type nftRules []nftRule
+
+// find returns the rule with given rulespec.
+func (list nftRules) find(rulespec []string) (nftRule, bool) {
+	spec := strings.Join(rulespec, " ")
+	for _, r := range list {
+		if r.spec == spec {
+			return r, true
+		}
+	}
+	return nftRule{}, false
+}
+
+// listRules returns all rules (created by this backend) in the given table/chain of the given nftables table.
+func (b *NFTablesBackend) listRules(nftTable, table, chain string) (nftRules, error) {
+	output, err := b.output("-a", "list", "chain", "inet", nftTable, nftChainName(table, chain))
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result nftRules
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := nftRuleLinePattern.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		handle, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, nftRule{spec: m[1], handle: handle})
+	}
+	return result, nil
+}
+
+// nftRuleExpression converts the given iptables rulespec into an nftables rule expression,
+// including a comment containing the original rulespec.
+func nftRuleExpression(table string, rulespec []string) ([]string, error) {
+	var expr []string
+	protocol := ""
+	next := func(i int) (string, error) {
+		if i+1 >= len(rulespec) {
+			return "", permanentErrorf("Missing value for '%s'", rulespec[i])
+		}
+		return rulespec[i+1], nil
+	}
+	for i := 0; i < len(rulespec); i++ {
+		arg := rulespec[i]
+		if arg == "-m" {
+			// Matches are implied by their options
+			i++
+			continue
+		}
+		value, err := next(i)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		i++
+		switch arg {
+		case "-p":
+			protocol = value
+			expr = append(expr, "meta", "l4proto", value)
+		case "--dport", "--sport":
+			if protocol == "" {
+				return nil, permanentErrorf("'%s' requires a protocol", arg)
+			}
+			expr = append(expr, protocol, strings.TrimPrefix(arg, "--"), strings.Replace(value, ":", "-", -1))
+		case "--dports", "--sports":
+			if protocol == "" {
+				return nil, permanentErrorf("'%s' requires a protocol", arg)
+			}
+			set := strings.Replace(strings.Replace(value, ":", "-", -1), ",", ", ", -1)
+			expr = append(expr, protocol, strings.TrimSuffix(strings.TrimPrefix(arg, "--"), "s"), "{", set, "}")
+		case "-s", "-d":
+			family := "ip"
+			if strings.Contains(value, ":") {
+				family = "ip6"
+			}
+			field := "saddr"
+			if arg == "-d" {
+				field = "daddr"
+			}
+			expr = append(expr, family, field, value)
+		case "-i":
+			expr = append(expr, "iifname", strconv.Quote(value))
+		case "-o":
+			expr = append(expr, "oifname", strconv.Quote(value))
+		case "-j":
+			switch value {
+			case "ACCEPT", "DROP", "RETURN":
+				expr = append(expr, strings.ToLower(value))
+			case "REJECT":
+				expr = append(expr, "reject")
+			case "MARK":
+				// The mark is set by --set-xmark
+			default:
+				expr = append(expr, "jump", nftChainName(table, value))
+			}
+		case "--reject-with":
+			with, found := nftRejectTypes[value]
+			if !found {
+				return nil, permanentErrorf("Unsupported reject type '%s' for nftables backend", value)
+			}
+			expr = append(expr, "with", with)
+		case "--mode":
+			// The mode is implied by --probability (random) or --every (nth)
+		case "--probability":
+			probability, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, permanentErrorf("Invalid probability '%s'", value)
+			}
+			expr = append(expr, "numgen", "random", "mod", "10000", "<", strconv.Itoa(int(probability*10000+0.5)))
+		case "--every":
+			expr = append(expr, "numgen", "inc", "mod", value)
+		case "--packet":
+			expr = append(expr, "==", value)
+		case "--ctdir":
+			expr = append(expr, "ct", "direction", strings.ToLower(value))
+		case "--set-xmark":
+			// Like iptables, clear the bits of the mask, then toggle the bits of the value
+			parts := strings.SplitN(value, "/", 2)
+			mark, err := strconv.ParseUint(parts[0], 0, 32)
+			mask := uint64(0xffffffff)
+			if err == nil && len(parts) == 2 {
+				mask, err = strconv.ParseUint(parts[1], 0, 32)
+			}
+			if err != nil {
+				return nil, permanentErrorf("Invalid mark '%s'", value)
+			}
+			expr = append(expr, "meta", "mark", "set", "meta", "mark", "and", fmt.Sprintf("0x%08x", ^uint32(mask)), "xor", fmt.Sprintf("0x%08x", mark))
+		default:
+			return nil, permanentErrorf("Unsupported argument '%s' for nftables backend", arg)
+		}
+	}
+	expr = append(expr, "comment", strconv.Quote(strings.Join(rulespec, " ")))
+	return expr, nil
+}
+
+// run executes the given nft command.
+func (b *NFTablesBackend) run(args ...string) error {
+	_, err := b.output(args...)
+	return maskAny(err)
+}
+
+// output executes the given nft command and returns its standard output.
+// nft joins all arguments before parsing them, so quoted strings may contain spaces.
+func (b *NFTablesBackend) output(args ...string) ([]byte, error) {
+	result, err := b.execute(nil, args...)
+	return result, maskAny(err)
+}
+
+// execute executes the given nft command with given standard input and returns its standard output.
+func (b *NFTablesBackend) execute(stdin io.Reader, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(b.path, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "busy") || strings.Contains(msg, "temporarily unavailable") {
+			return nil, maskAny(fmt.Errorf("nft %s failed: %v: %s", strings.Join(args, " "), err, msg))
+		}
+		// nft fails immediately on invalid rules or missing modules, retrying does not help
+		return nil, permanentErrorf("nft %s failed: %v: %s", strings.Join(args, " "), err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// nftChainName returns the name of the nftables chain used for the given iptables table/chain.
+func nftChainName(table, chain string) string {
+	if table == "filter" {
+		return chain
+	}
+	return table + "-" + chain
+}
+
+// parseNFTChainName returns the iptables table & chain of the given nftables chain name.
+// It is the inverse of nftChainName.
+func parseNFTChainName(name string) (table, chain string) {
+	for table := range builtinChains {
+		if table != "filter" && strings.HasPrefix(name, table+"-") {
+			return table, strings.TrimPrefix(name, table+"-")
+		}
+	}
+	return "filter", name
+}
+
+// isBuiltinNFTChain returns true if the given nftables chain name is used for a built-in iptables chain.
+func isBuiltinNFTChain(name string) bool {
+	for table, chains := range builtinChains {
+		for _, chain := range chains {
+			if nftChainName(table, chain) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
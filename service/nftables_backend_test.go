@@ -0,0 +1,169 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNFTRuleExpression(t *testing.T) {
+	tests := []struct {
+		table    string
+		rulespec string
+		expected string
+		err      bool
+	}{
+		{
+			table:    "filter",
+			rulespec: "-p tcp -m tcp --dport 8529 -j REJECT",
+			expected: "meta l4proto tcp tcp dport 8529 reject",
+		},
+		{
+			table:    "filter",
+			rulespec: "-p udp -m udp --sport 53 -j DROP",
+			expected: "meta l4proto udp udp sport 53 drop",
+		},
+		{
+			table:    "filter",
+			rulespec: "-p tcp -m multiport --dports 80,8529:8539 -j DROP",
+			expected: "meta l4proto tcp tcp dport { 80, 8529-8539 } drop",
+		},
+		{
+			table:    "filter",
+			rulespec: "-s 10.0.0.0/8 -i eth0 -j DROP",
+			expected: `ip saddr 10.0.0.0/8 iifname "eth0" drop`,
+		},
+		{
+			table:    "filter",
+			rulespec: "-s 10.0.0.5/32 -m conntrack --ctdir ORIGINAL -j DROP",
+			expected: "ip saddr 10.0.0.5/32 ct direction original drop",
+		},
+		{
+			table:    "filter",
+			rulespec: "-d fd00::1/128 -o eth1 -j DROP",
+			expected: `ip6 daddr fd00::1/128 oifname "eth1" drop`,
+		},
+		{
+			table:    "filter",
+			rulespec: "-p udp -m udp --dport 53 -j REJECT --reject-with icmp-port-unreachable",
+			expected: "meta l4proto udp udp dport 53 reject with icmpx type port-unreachable",
+		},
+		{
+			table:    "filter",
+			rulespec: "-p udp -m udp --dport 53 -j REJECT --reject-with icmp6-port-unreachable",
+			expected: "meta l4proto udp udp dport 53 reject with icmpx type port-unreachable",
+		},
+		{
+			table:    "filter",
+			rulespec: "-p tcp -m tcp --dport 8529 -j REJECT --reject-with tcp-reset",
+			expected: "meta l4proto tcp tcp dport 8529 reject with tcp reset",
+		},
+		{
+			table:    "filter",
+			rulespec: "-j NETBLK-0123abcd-IN",
+			expected: "jump NETBLK-0123abcd-IN",
+		},
+		{
+			table:    "mangle",
+			rulespec: "-j NETBLK-0123abcd-MARK",
+			expected: "jump mangle-NETBLK-0123abcd-MARK",
+		},
+		{
+			table:    "filter",
+			rulespec: "-j RETURN",
+			expected: "return",
+		},
+		{
+			table:    "filter",
+			rulespec: "-s 10.0.0.5/32 -m statistic --mode random --probability 0.1 -j DROP",
+			expected: "ip saddr 10.0.0.5/32 numgen random mod 10000 < 1000 drop",
+		},
+		{
+			table:    "filter",
+			rulespec: "-s 10.0.0.5/32 -m statistic --mode nth --every 4 --packet 0 -j DROP",
+			expected: "ip saddr 10.0.0.5/32 numgen inc mod 4 == 0 drop",
+		},
+		{
+			table:    "mangle",
+			rulespec: "-p tcp -m tcp --dport 8529 -j MARK --set-xmark 0x4000000/0x1f000000",
+			expected: "meta l4proto tcp tcp dport 8529 meta mark set meta mark and 0xe0ffffff xor 0x04000000",
+		},
+		{
+			table:    "mangle",
+			rulespec: "-j MARK --set-xmark 0x10000000",
+			expected: "meta mark set meta mark and 0x00000000 xor 0x10000000",
+		},
+		{table: "filter", rulespec: "-m tcp --dport 8529 -j DROP", err: true},
+		{table: "filter", rulespec: "-m multiport --dports 80,443 -j DROP", err: true},
+		{table: "filter", rulespec: "-p tcp -j REJECT --reject-with icmp-proto-unreachable", err: true},
+		{table: "filter", rulespec: "-p tcp -m tcp --dport", err: true},
+		{table: "filter", rulespec: "-p tcp --syn -j DROP", err: true},
+		{table: "mangle", rulespec: "-j MARK --set-xmark 0x4000000/mask", err: true},
+	}
+	for _, test := range tests {
+		rulespec := strings.Split(test.rulespec, " ")
+		expr, err := nftRuleExpression(test.table, rulespec)
+		if test.err {
+			if err == nil {
+				t.Errorf("nftRuleExpression(%q): expected error, got %q", test.rulespec, strings.Join(expr, " "))
+			} else if isTransient(err) {
+				t.Errorf("nftRuleExpression(%q): expected permanent error, got %v", test.rulespec, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nftRuleExpression(%q): unexpected error: %v", test.rulespec, err)
+			continue
+		}
+		// The original rulespec is added as comment
+		expected := test.expected + ` comment "` + test.rulespec + `"`
+		if actual := strings.Join(expr, " "); actual != expected {
+			t.Errorf("nftRuleExpression(%q): expected %q, got %q", test.rulespec, expected, actual)
+		}
+	}
+}
+
+func TestNFTChainName(t *testing.T) {
+	tests := []struct {
+		table string
+		chain string
+		name  string
+	}{
+		{table: "filter", chain: "INPUT", name: "INPUT"},
+		{table: "filter", chain: "NETBLK-0123abcd-IN", name: "NETBLK-0123abcd-IN"},
+		{table: "mangle", chain: "POSTROUTING", name: "mangle-POSTROUTING"},
+		{table: "mangle", chain: "NETBLK-0123abcd-MARK", name: "mangle-NETBLK-0123abcd-MARK"},
+	}
+	for _, test := range tests {
+		if name := nftChainName(test.table, test.chain); name != test.name {
+			t.Errorf("nftChainName(%s, %s): expected %s, got %s", test.table, test.chain, test.name, name)
+		}
+		if table, chain := parseNFTChainName(test.name); table != test.table || chain != test.chain {
+			t.Errorf("parseNFTChainName(%s): expected %s/%s, got %s/%s", test.name, test.table, test.chain, table, chain)
+		}
+	}
+}
+
+func TestNFTTableName(t *testing.T) {
+	b := &NFTablesBackend{table: "netblk-0123abcd"}
+	tests := []struct {
+		chain    string
+		rulespec string
+		expected string
+	}{
+		{chain: "NETBLK-0123abcd-IN", expected: "netblk-0123abcd"},
+		{chain: "NETBLK-4567cdef-OUT", expected: "netblk-4567cdef"},
+		{chain: "NETBLK-0123abcd-S1-IN", expected: "netblk-0123abcd"},
+		{chain: "INPUT", expected: "netblk-0123abcd"},
+		{chain: "INPUT", rulespec: "-j NETBLK-4567cdef-IN", expected: "netblk-4567cdef"},
+		{chain: "NETBLK-0123abcd-IN", rulespec: "-j NETBLK-0123abcd-S1-IN", expected: "netblk-0123abcd"},
+	}
+	for _, test := range tests {
+		var rulespec []string
+		if test.rulespec != "" {
+			rulespec = strings.Split(test.rulespec, " ")
+		}
+		if name := b.tableName(test.chain, rulespec); name != test.expected {
+			t.Errorf("tableName(%s, %q): expected %s, got %s", test.chain, test.rulespec, test.expected, name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// OrphansDelete removes chains left behind by previous instances of the service
+	OrphansDelete = "delete"
+	// OrphansAdopt takes over chains left behind by a previous instance of the service (keeping its rules)
+	OrphansAdopt = "adopt"
+)
+
+var (
+	// serviceChainPattern matches the chains created by a service, capturing the base name (NETBLK-<id>)
+	serviceChainPattern = regexp.MustCompile(`^(NETBLK-[0-9a-f]+)(-.+)?$`)
+)
+
+// handleOrphans looks for chains left behind by other (killed) instances of the service
+// and removes or adopts them, depending on the configured orphans mode.
+// Returns true if chains of another instance have been adopted.
+func (s *Service) handleOrphans() (bool, error) {
+	orphans := make(map[string][]string)
+	for _, c := range s.clients {
+		for _, table := range serviceTables {
+			chains, err := c.ListChains(table)
+			if err != nil {
+				return false, maskAny(err)
+			}
+			for _, chain := range chains {
+				if m := serviceChainPattern.FindStringSubmatch(chain); m != nil && m[1] != s.chainName {
+					orphans[m[1]] = appendUnique(orphans[m[1]], chain)
+				}
+			}
+		}
+	}
+	if len(orphans) == 0 {
+		s.Logger.Debug("No orphaned chains found")
+		return false, nil
+	}
+	var bases []string
+	for base, chains := range orphans {
+		s.Logger.Infof("Found orphaned chains of %s: %s", base, strings.Join(chains, ", "))
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	adopted := false
+	if s.Orphans == OrphansAdopt {
+		s.chainName = bases[0]
+		bases = bases[1:]
+		adopted = true
+		s.Logger.Infof("Adopting chains of %s, existing rules are kept but not listed", s.chainName)
+	}
+	for _, base := range bases {
+		s.Logger.Infof("Removing orphaned chains of %s", base)
+		for _, c := range s.clients {
+			for _, table := range serviceTables {
+				if err := removeChains(c, table, base); err != nil {
+					s.Logger.Warningf("Failed to remove %s orphaned %s chains of %s: %v", c.family, table, base, err)
+				}
+			}
+		}
+	}
+	return adopted, nil
+}
+
+// removeChains removes all chains in the given table that belong to the service with given base chain name,
+// including the rules in built-in chains that jump to them.
+func removeChains(b Backend, table, base string) error {
+	belongsToBase := func(chain string) bool {
+		m := serviceChainPattern.FindStringSubmatch(chain)
+		return m != nil && m[1] == base
+	}
+	for _, builtin := range builtinChains[table] {
+		rules, err := listBuiltin(b, table, builtin, base)
+		if err != nil {
+			return maskAny(err)
+		}
+		prefix := "-A " + builtin + " "
+		for _, rule := range rules {
+			if !strings.HasPrefix(rule, prefix) {
+				continue
+			}
+			spec := strings.Fields(strings.TrimPrefix(rule, prefix))
+			if target := specTarget(spec); belongsToBase(target) {
+				if err := b.Delete(table, builtin, spec...); err != nil {
+					return maskAny(err)
+				}
+			}
+		}
+	}
+	chains, err := b.ListChains(table)
+	if err != nil {
+		return maskAny(err)
+	}
+	var stale []string
+	for _, chain := range chains {
+		if belongsToBase(chain) {
+			stale = append(stale, chain)
+		}
+	}
+	// Clear all chains first, since they may jump to each other
+	for _, chain := range stale {
+		if err := b.ClearChain(table, chain); err != nil {
+			return maskAny(err)
+		}
+	}
+	for _, chain := range stale {
+		if err := b.DeleteChain(table, chain); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// specTarget returns the target (-j) of the given rulespec, or an empty string if it has none.
+func specTarget(spec []string) string {
+	for i, arg := range spec {
+		if arg == "-j" && i+1 < len(spec) {
+			return spec[i+1]
+		}
+	}
+	return ""
+}
+
+// containsString returns true if the given slice contains the given value.
+func containsString(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends the given value to the given slice, unless the slice already contains it.
+func appendUnique(list []string, value string) []string {
+	if containsString(list, value) {
+		return list
+	}
+	return append(list, value)
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// serviceChains returns the chains of all service instances in the filter table of the given backend.
+func serviceChains(t *testing.T, backend Backend) []string {
+	chains, err := backend.ListChains(filterTable)
+	if err != nil {
+		t.Fatalf("ListChains failed: %v", err)
+	}
+	var result []string
+	for _, chain := range chains {
+		if serviceChainPattern.MatchString(chain) {
+			result = append(result, chain)
+		}
+	}
+	return result
+}
+
+// newOrphan creates a service with a rule & an active rule set that is never cleaned up,
+// leaving its chains behind like a killed instance.
+func newOrphan(t *testing.T, backend Backend) *Service {
+	s := newTestServiceWithBackend(t, backend)
+	ctx := context.Background()
+	if err := s.DropTCP(ctx, Ports{{80, 80}}, DirectionBoth, RuleOptions{}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.PutRuleSet(ctx, "db2", []Rule{{Source: "10.0.0.2", Action: ActionDrop}}); err != nil {
+		t.Fatalf("PutRuleSet failed: %v", err)
+	}
+	if err := s.ActivateRuleSet(ctx, "db2"); err != nil {
+		t.Fatalf("ActivateRuleSet failed: %v", err)
+	}
+	s.stopExpiryTimers()
+	return s
+}
+
+// addStaleChains adds chains (with a rule) for the service instance with given base chain name to the given backend,
+// as well as the jumps to them.
+func addStaleChains(t *testing.T, backend Backend, base string) {
+	for _, h := range allHooks {
+		chain := h.chainName(base)
+		if err := backend.ClearChain(h.table, chain); err != nil {
+			t.Fatalf("ClearChain failed: %v", err)
+		}
+		if err := backend.Append(h.table, chain, "-p", "udp", "-m", "udp", "--dport", "53", "-j", "DROP"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if err := backend.Insert(h.table, h.builtin, 1, "-j", chain); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+}
+
+// TestOrphansDelete checks that the chains of killed instances (including the chains of their rule sets)
+// and the jumps to them are removed at startup.
+func TestOrphansDelete(t *testing.T) {
+	backend := NewMemoryBackend()
+	newOrphan(t, backend)
+	addStaleChains(t, backend, "NETBLK-ffffffff")
+
+	s := newTestServiceWithConfig(t, ServiceConfig{Orphans: OrphansDelete}, backend)
+	var expected []string
+	for _, h := range allHooks {
+		expected = append(expected, h.chainName(s.chainName))
+		expectRules(t, backend, h.table, h.builtin, "-j "+h.chainName(s.chainName))
+	}
+	sort.Strings(expected)
+	if chains := serviceChains(t, backend); strings.Join(chains, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected only chains %q, got %q", expected, chains)
+	}
+
+	if err := s.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if chains := serviceChains(t, backend); len(chains) != 0 {
+		t.Errorf("Expected no service chains, got %q", chains)
+	}
+}
+
+// TestOrphansAdopt checks that the chains (and rules) of the first killed instance are adopted at startup,
+// while the chains of other killed instances are removed.
+func TestOrphansAdopt(t *testing.T) {
+	backend := NewMemoryBackend()
+	adopted := newOrphan(t, backend)
+	sets := adopted.RuleSets()
+	// The orphan with the lowest chain name is adopted
+	removed := "NETBLK-ffffffff"
+	addStaleChains(t, backend, removed)
+
+	s := newTestServiceWithConfig(t, ServiceConfig{Orphans: OrphansAdopt}, backend)
+	defer s.Cleanup()
+
+	if s.chainName != adopted.chainName {
+		t.Fatalf("Expected chains of %s to be adopted, got %s", adopted.chainName, s.chainName)
+	}
+	for _, h := range allHooks {
+		chain := h.chainName(s.chainName)
+		expectRules(t, backend, h.table, h.builtin, "-j "+chain)
+		// Existing rules are kept (but not listed)
+		expectRules(t, backend, h.table, chain, "-j "+adopted.setChainName(&sets[0], h), "-p tcp -m tcp --dport 80 -j DROP")
+	}
+	if rules := s.Rules(); len(rules) != 0 {
+		t.Errorf("Expected no listed rules, got %+v", rules)
+	}
+	for _, chain := range serviceChains(t, backend) {
+		if strings.HasPrefix(chain, removed+"-") {
+			t.Errorf("Expected chain %s to be removed", chain)
+		}
+	}
+}
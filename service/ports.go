@@ -0,0 +1,119 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// Ports is a list of ports and port ranges.
+type Ports []PortRange
+
+const (
+	// maxMultiportPorts is the maximum number of ports in a multiport match.
+	// A port range counts as 2 ports.
+	maxMultiportPorts = 15
+)
+
+// ParsePorts parses a comma separated list of ports and port ranges,
+// e.g. `8529`, `8529-8539` or `8529,8531,8600-8610`.
+func ParsePorts(value string) (Ports, error) {
+	var result Ports
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parsePort(bounds[1]); err != nil {
+				return nil, maskAny(err)
+			}
+		}
+		if first > last {
+			return nil, validationErrorf("Invalid port range '%s'", part)
+		}
+		result = append(result, PortRange{First: first, Last: last})
+	}
+	count := 0
+	for _, r := range result {
+		if r.First == r.Last {
+			count++
+		} else {
+			count += 2
+		}
+	}
+	if count > maxMultiportPorts {
+		return nil, validationErrorf("Too many ports in '%s' (at most %d, a range counts as 2)", value, maxMultiportPorts)
+	}
+	return result, nil
+}
+
+// parsePort parses a single port number.
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, validationErrorf("Invalid port '%s'", value)
+	}
+	return port, nil
+}
+
+// String returns the ports in the same format accepted by ParsePorts.
+func (p Ports) String() string {
+	return p.join("-")
+}
+
+// MarshalJSON encodes the ports as a string in the format accepted by ParsePorts.
+func (p Ports) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON decodes the ports from a string in the format accepted by ParsePorts,
+// or from a single port number.
+func (p *Ports) UnmarshalJSON(data []byte) error {
+	var value string
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		value = strconv.Itoa(port)
+	} else if err := json.Unmarshal(data, &value); err != nil {
+		return validationErrorf("Invalid ports %s", string(data))
+	}
+	ports, err := ParsePorts(value)
+	if err != nil {
+		return maskAny(err)
+	}
+	*p = ports
+	return nil
+}
+
+// join returns all ports separated by a comma, using the given separator for ranges.
+func (p Ports) join(rangeSeparator string) string {
+	parts := make([]string, 0, len(p))
+	for _, r := range p {
+		if r.First == r.Last {
+			parts = append(parts, strconv.Itoa(r.First))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d%s%d", r.First, rangeSeparator, r.Last))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// createMatchSpec returns the rulespec arguments that match the ports of the given protocol.
+// A single port is matched with the protocol match, anything else with the multiport match.
+// The direction is either "d" (destination) or "s" (source).
+func (p Ports) createMatchSpec(protocol, direction string) []string {
+	if len(p) == 1 && p[0].First == p[0].Last {
+		return []string{"-m", protocol, "--" + direction + "port", strconv.Itoa(p[0].First)}
+	}
+	return []string{"-m", "multiport", "--" + direction + "ports", p.join(":")}
+}
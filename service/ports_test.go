@@ -0,0 +1,62 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Ports
+		err      bool
+	}{
+		{value: "8529", expected: Ports{{8529, 8529}}},
+		{value: "8529-8539", expected: Ports{{8529, 8539}}},
+		{value: "8529,8531,8600-8610", expected: Ports{{8529, 8529}, {8531, 8531}, {8600, 8610}}},
+		{value: " 80 , 443 ", expected: Ports{{80, 80}, {443, 443}}},
+		{value: "1-65535", expected: Ports{{1, 65535}}},
+		{value: "1,2,3,4,5,6,7,8,9,10,11,12,13,14,15", expected: Ports{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}, {7, 7}, {8, 8}, {9, 9}, {10, 10}, {11, 11}, {12, 12}, {13, 13}, {14, 14}, {15, 15}}},
+		{value: "1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16", err: true},
+		{value: "1-2,3-4,5-6,7-8,9-10,11-12,13-14,15-16", err: true},
+		{value: "", err: true},
+		{value: "0", err: true},
+		{value: "65536", err: true},
+		{value: "http", err: true},
+		{value: "8539-8529", err: true},
+		{value: "8529-", err: true},
+		{value: "8529,", err: true},
+	}
+	for _, test := range tests {
+		ports, err := ParsePorts(test.value)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("ParsePorts(%q): expected error, got %v", test.value, ports)
+		case test.err && !IsValidation(err):
+			t.Errorf("ParsePorts(%q): expected validation error, got %v", test.value, err)
+		case !test.err && err != nil:
+			t.Errorf("ParsePorts(%q): unexpected error: %v", test.value, err)
+		case !test.err && !reflect.DeepEqual(ports, test.expected):
+			t.Errorf("ParsePorts(%q): expected %v, got %v", test.value, test.expected, ports)
+		}
+	}
+}
+
+func TestPortsCreateMatchSpec(t *testing.T) {
+	tests := []struct {
+		ports     Ports
+		direction string
+		expected  string
+	}{
+		{ports: Ports{{8529, 8529}}, direction: "d", expected: "-m tcp --dport 8529"},
+		{ports: Ports{{8529, 8529}}, direction: "s", expected: "-m tcp --sport 8529"},
+		{ports: Ports{{8529, 8539}}, direction: "d", expected: "-m multiport --dports 8529:8539"},
+		{ports: Ports{{80, 80}, {8600, 8610}}, direction: "d", expected: "-m multiport --dports 80,8600:8610"},
+	}
+	for _, test := range tests {
+		if spec := strings.Join(test.ports.createMatchSpec("tcp", test.direction), " "); spec != test.expected {
+			t.Errorf("createMatchSpec(%s, %s): expected %q, got %q", test.ports, test.direction, test.expected, spec)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DriftKind identifies the kind of difference found between the desired and the actual state.
+type DriftKind string
+
+const (
+	// DriftMissingChain means a chain of the service has been removed
+	DriftMissingChain DriftKind = "missing-chain"
+	// DriftMissingJump means the rule jumping from a built-in chain to a chain of the service has been removed
+	DriftMissingJump DriftKind = "missing-jump"
+	// DriftMisplacedJump means the rule jumping from a built-in chain to a chain of the service is no longer the first rule
+	DriftMisplacedJump DriftKind = "misplaced-jump"
+	// DriftMissingRule means a rule of the service has been removed
+	DriftMissingRule DriftKind = "missing-rule"
+)
+
+const (
+	// maxDriftEvents is the number of drift events kept by the service
+	maxDriftEvents = 100
+)
+
+// DriftEvent describes a difference between the desired and the actual state, found by the reconciler.
+type DriftEvent struct {
+	// Time the drift was detected
+	Time time.Time `json:"time"`
+	// Kind of drift
+	Kind DriftKind `json:"kind"`
+	// Address family of the backend in which the drift was found
+	Family string `json:"family"`
+	// Chain in which the drift was found
+	Chain string `json:"chain"`
+	// Human readable description of the drift
+	Message string `json:"message"`
+	// Set if the drift has been repaired
+	Repaired bool `json:"repaired"`
+}
+
+// startReconciler starts a background loop that reconciles the actual state with the
+// desired state at the configured interval (if any).
+func (s *Service) startReconciler() {
+	if s.ReconcileInterval <= 0 {
+		return
+	}
+	s.reconcileStop = make(chan struct{})
+	s.reconcileDone = make(chan struct{})
+	go func() {
+		defer close(s.reconcileDone)
+		ticker := time.NewTicker(s.ReconcileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Reconcile()
+			case <-s.reconcileStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopReconciler stops the background reconcile loop (if any) and waits until it has terminated.
+func (s *Service) stopReconciler() {
+	if s.reconcileStop == nil {
+		return
+	}
+	close(s.reconcileStop)
+	<-s.reconcileDone
+	s.reconcileStop = nil
+}
+
+// Reconcile compares the actual chains & rules with the desired state and re-applies everything that is missing.
+// Every difference is logged & recorded as drift event.
+func (s *Service) Reconcile() {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	rules := s.Rules()
+	sets := s.RuleSets()
+	for _, c := range s.clients {
+		if err := s.reconcileClient(c, rules, sets); err != nil {
+			s.Logger.Errorf("Failed to reconcile %s rules: %v", c.family, err)
+		}
+	}
+}
+
+// reconcileClient reconciles the chains & rules in the backend of the given client.
+func (s *Service) reconcileClient(c client, rules []AppliedRule, sets []RuleSet) error {
+	chains := make(map[string][]string)
+	for _, h := range s.hooks() {
+		if _, found := chains[h.table]; !found {
+			list, err := c.ListChains(h.table)
+			if err != nil {
+				return maskAny(err)
+			}
+			chains[h.table] = list
+		}
+		chain := h.chainName(s.chainName)
+
+		// Check the chain itself
+		if !containsString(chains[h.table], chain) {
+			err := c.ClearChain(h.table, chain)
+			s.recordDrift(c, DriftMissingChain, chain, fmt.Sprintf("Chain '%s' is missing", chain), err)
+			if err != nil {
+				return maskAny(err)
+			}
+		}
+		if found, err := c.Exists(h.table, chain, "-j", "RETURN"); err != nil {
+			return maskAny(err)
+		} else if !found {
+			if err := c.Append(h.table, chain, "-j", "RETURN"); err != nil {
+				return maskAny(err)
+			}
+		}
+
+		// Check the jump from the built-in chain
+		if err := s.reconcileJump(c, h, chain); err != nil {
+			return maskAny(err)
+		}
+
+		// Check the rules in the chain
+		for _, r := range rules {
+			rule, family, err := r.Rule.normalize()
+			if err != nil || c.family&family == 0 || !containsHook(rule.hooks(), h) {
+				continue
+			}
+			ruleSpec := rule.createActionSpec(c.family, r.class)
+			if found, err := c.Exists(h.table, chain, ruleSpec...); err != nil {
+				return maskAny(err)
+			} else if !found {
+				err := c.Insert(h.table, chain, 1, ruleSpec...)
+				s.recordDrift(c, DriftMissingRule, chain, fmt.Sprintf("Rule %s (%s) is missing", r.ID, rule), err)
+				if err != nil {
+					return maskAny(err)
+				}
+			}
+		}
+
+		// Check the chains of the rule sets
+		if !containsHook(allHooks, h) {
+			continue
+		}
+		for i := range sets {
+			if err := s.reconcileRuleSet(c, chains[h.table], &sets[i], h); err != nil {
+				return maskAny(err)
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileRuleSet reconciles the chain of the given rule set for the given hook,
+// and the jump to it if the set is active.
+func (s *Service) reconcileRuleSet(c client, chains []string, set *RuleSet, h hook) error {
+	chain := s.setChainName(set, h)
+	if !containsString(chains, chain) {
+		err := c.ClearChain(h.table, chain)
+		s.recordDrift(c, DriftMissingChain, chain, fmt.Sprintf("Chain '%s' of rule set '%s' is missing", chain, set.Name), err)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+	for i, rule := range set.Rules {
+		if c.family&set.families[i] == 0 || !containsHook(rule.Direction.hooks(), h) {
+			continue
+		}
+		ruleSpec := rule.createRuleSpec(c.family, rule.Action.target())
+		if found, err := c.Exists(h.table, chain, ruleSpec...); err != nil {
+			return maskAny(err)
+		} else if !found {
+			err := c.Append(h.table, chain, ruleSpec...)
+			s.recordDrift(c, DriftMissingRule, chain, fmt.Sprintf("Rule %d of rule set '%s' (%s) is missing", i+1, set.Name, rule), err)
+			if err != nil {
+				return maskAny(err)
+			}
+		}
+	}
+	if !set.Active {
+		return nil
+	}
+	mainChain := h.chainName(s.chainName)
+	if found, err := c.Exists(h.table, mainChain, "-j", chain); err != nil {
+		return maskAny(err)
+	} else if !found {
+		err := c.Insert(h.table, mainChain, 1, "-j", chain)
+		s.recordDrift(c, DriftMissingJump, mainChain, fmt.Sprintf("Jump to '%s' of rule set '%s' is missing", chain, set.Name), err)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// reconcileJump ensures that the first rule of the built-in chain of the given hook jumps to the given chain.
+func (s *Service) reconcileJump(c client, h hook, chain string) error {
+	list, err := listBuiltin(c.Backend, h.table, h.builtin, s.chainName)
+	if err != nil {
+		return maskAny(err)
+	}
+	prefix := "-A " + h.builtin + " "
+	jump := prefix + "-j " + chain
+	// Find the position of the jump (0 if missing)
+	position, index := 0, 0
+	for _, rule := range list {
+		if !strings.HasPrefix(rule, prefix) {
+			continue
+		}
+		index++
+		if rule == jump {
+			position = index
+			break
+		}
+	}
+	switch position {
+	case 1:
+		// Jump is in place
+		return nil
+	case 0:
+		err := c.Insert(h.table, h.builtin, 1, "-j", chain)
+		s.recordDrift(c, DriftMissingJump, h.builtin, fmt.Sprintf("Jump to '%s' is missing", chain), err)
+		return maskAny(err)
+	default:
+		if err := c.Delete(h.table, h.builtin, "-j", chain); err != nil {
+			return maskAny(err)
+		}
+		err := c.Insert(h.table, h.builtin, 1, "-j", chain)
+		s.recordDrift(c, DriftMisplacedJump, h.builtin, fmt.Sprintf("Jump to '%s' is at position %d", chain, position), err)
+		return maskAny(err)
+	}
+}
+
+// recordDrift logs the given drift and adds it to the list of drift events.
+// The given error is the result of repairing the drift.
+func (s *Service) recordDrift(c client, kind DriftKind, chain, message string, repairErr error) {
+	event := DriftEvent{
+		Time:     time.Now(),
+		Kind:     kind,
+		Family:   c.family.String(),
+		Chain:    chain,
+		Message:  message,
+		Repaired: repairErr == nil,
+	}
+	if repairErr == nil {
+		s.Logger.Warningf("Drift detected in %s '%s' chain: %s (repaired)", c.family, chain, message)
+	} else {
+		s.Logger.Errorf("Drift detected in %s '%s' chain: %s (repair failed: %v)", c.family, chain, message, repairErr)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.driftEvents = append(s.driftEvents, event)
+	if len(s.driftEvents) > maxDriftEvents {
+		s.driftEvents = s.driftEvents[len(s.driftEvents)-maxDriftEvents:]
+	}
+}
+
+// DriftEvents returns the most recent drift events, oldest first.
+func (s *Service) DriftEvents() []DriftEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]DriftEvent{}, s.driftEvents...)
+}
+
+// containsHook returns true if the given list contains the given hook.
+func containsHook(hooks []hook, h hook) bool {
+	for _, x := range hooks {
+		if x == h {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// listChain returns the rules in the given chain (the built-in chain of the given hook, or a chain of the service).
+// The order of the rules in a chain of the service does not matter, so these are sorted.
+func listChain(t *testing.T, backend Backend, h hook, chain string) []string {
+	list := listRules(t, backend, h.table, chain)
+	if chain != h.builtin {
+		sort.Strings(list)
+	}
+	return list
+}
+
+// TestReconcileRepairsDrift breaks the chains of a service in different ways, like other tools on a host do,
+// and checks that Reconcile reports & repairs the drift.
+func TestReconcileRepairsDrift(t *testing.T) {
+	drop := strings.Fields("-p tcp -m tcp --dport 80 -j DROP")
+	tests := []struct {
+		name string
+		// drift changes the given backend behind the back of the given service
+		drift    func(s *Service, b *MemoryBackend) error
+		expected []DriftKind
+	}{
+		{
+			name: "missing jump",
+			drift: func(s *Service, b *MemoryBackend) error {
+				return b.Delete(filterTable, "INPUT", "-j", inputHook.chainName(s.chainName))
+			},
+			expected: []DriftKind{DriftMissingJump},
+		},
+		{
+			name: "misplaced jump",
+			drift: func(s *Service, b *MemoryBackend) error {
+				return b.Insert(filterTable, "OUTPUT", 1, "-j", "ACCEPT")
+			},
+			expected: []DriftKind{DriftMisplacedJump},
+		},
+		{
+			name: "missing rule",
+			drift: func(s *Service, b *MemoryBackend) error {
+				return b.Delete(filterTable, forwardHook.chainName(s.chainName), drop...)
+			},
+			expected: []DriftKind{DriftMissingRule},
+		},
+		{
+			name: "missing chain",
+			drift: func(s *Service, b *MemoryBackend) error {
+				chain := forwardHook.chainName(s.chainName)
+				if err := b.Delete(filterTable, "FORWARD", "-j", chain); err != nil {
+					return err
+				}
+				if err := b.ClearChain(filterTable, chain); err != nil {
+					return err
+				}
+				return b.DeleteChain(filterTable, chain)
+			},
+			// The jump from the built-in chain, the rule & the jump to the rule set are missing as well
+			expected: []DriftKind{DriftMissingChain, DriftMissingJump, DriftMissingRule, DriftMissingJump},
+		},
+		{
+			name: "missing rule set jump",
+			drift: func(s *Service, b *MemoryBackend) error {
+				sets := s.RuleSets()
+				return b.Delete(filterTable, inputHook.chainName(s.chainName), "-j", s.setChainName(&sets[0], inputHook))
+			},
+			expected: []DriftKind{DriftMissingJump},
+		},
+	}
+	for _, test := range tests {
+		s, backend := newTestService(t)
+		ctx := context.Background()
+		if err := s.DropTCP(ctx, Ports{{80, 80}}, DirectionBoth, RuleOptions{}); err != nil {
+			t.Fatalf("DropTCP failed: %v", err)
+		}
+		if err := s.PutRuleSet(ctx, "db2", []Rule{{Source: "10.0.0.2", Direction: DirectionIn, Action: ActionDrop}}); err != nil {
+			t.Fatalf("PutRuleSet failed: %v", err)
+		}
+		if err := s.ActivateRuleSet(ctx, "db2"); err != nil {
+			t.Fatalf("ActivateRuleSet failed: %v", err)
+		}
+		// Keep the chains as they are before the drift
+		expected := make(map[string][]string)
+		for _, h := range allHooks {
+			for _, chain := range []string{h.builtin, h.chainName(s.chainName)} {
+				expected[chain] = listChain(t, backend, h, chain)
+			}
+		}
+
+		if err := test.drift(s, backend); err != nil {
+			t.Fatalf("%s: drift failed: %v", test.name, err)
+		}
+		s.Reconcile()
+		var kinds []DriftKind
+		for _, e := range s.DriftEvents() {
+			kinds = append(kinds, e.Kind)
+			if !e.Repaired {
+				t.Errorf("%s: expected drift to be repaired, got %+v", test.name, e)
+			}
+		}
+		if !reflect.DeepEqual(kinds, test.expected) {
+			t.Errorf("%s: expected drift events %v, got %+v", test.name, test.expected, s.DriftEvents())
+		}
+		for _, h := range allHooks {
+			for _, chain := range []string{h.builtin, h.chainName(s.chainName)} {
+				list := listChain(t, backend, h, chain)
+				if chain == "OUTPUT" && test.name == "misplaced jump" {
+					// The other rule stays, after the jump
+					list = append(list[:1], list[2:]...)
+				}
+				if !reflect.DeepEqual(list, expected[chain]) {
+					t.Errorf("%s: expected %q in %s, got %q", test.name, expected[chain], chain, list)
+				}
+			}
+			chain := h.chainName(s.chainName)
+			if list, err := backend.List(h.table, chain); err != nil {
+				t.Fatalf("%s: List failed: %v", test.name, err)
+			} else if list[len(list)-1] != "-A "+chain+" -j RETURN" {
+				t.Errorf("%s: expected %s to end with a RETURN rule, got %q", test.name, chain, list)
+			}
+		}
+
+		// Once repaired, there is no more drift
+		s.Reconcile()
+		if events := s.DriftEvents(); len(events) != len(test.expected) {
+			t.Errorf("%s: expected no new drift events, got %+v", test.name, events[len(test.expected):])
+		}
+		s.Cleanup()
+	}
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// AppliedRule is a rule that has been applied by the service.
+type AppliedRule struct {
+	// ID of the rule, unique within the service
+	ID string `json:"id"`
+	Rule
+	// Time the rule was applied
+	CreatedAt time.Time `json:"created_at"`
+	// Time the rule will be removed automatically (if it has a TTL)
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Time left until the rule is removed automatically (if it has a TTL)
+	Remaining Duration `json:"remaining,omitempty"`
+
+	// Traffic control class of a shaping rule
+	class       int
+	expiryTimer *time.Timer
+}
+
+// key returns the key of the rule in the registry.
+// Rules with the same match & direction have the same key, regardless of their action.
+func (r Rule) key() string {
+	return r.String()
+}
+
+// matchKey returns a key of the traffic matched by the rule, regardless of its direction & action.
+func (r Rule) matchKey() string {
+	r.Direction = ""
+	return r.String()
+}
+
+// covers returns true if the rule replaces (or for an accept rule, removes) the given rule with the same match.
+// A rule covers rules with the same direction, a rule with direction both covers rules of all directions.
+// Shaping rules share the mark hook, so a shaping rule covers all shaping rules with the same match.
+// A removal rule only covers the rule with the same direction.
+func (r Rule) covers(other Rule) bool {
+	if r.exact {
+		return r.Direction == other.Direction
+	}
+	return r.Direction == other.Direction || r.Direction == DirectionBoth ||
+		(r.Action.isShaping() && other.Action.isShaping())
+}
+
+// registerRule records the given (normalized) rule as applied, using the given traffic control class (shaping rules only).
+// The given replaced rules (rules with the same match covered by the given rule) are removed from the registry,
+// so an accept rule removes all rules it covers.
+// Re-applying a rule with the same action & direction keeps the existing record, but updates its options.
+func (s *Service) registerRule(rule Rule, replaced []plannedRule, class int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := rule.key()
+	for _, p := range replaced {
+		if k := p.rule.key(); k != key {
+			if r, found := s.rules[k]; found {
+				r.stopExpiryTimer()
+				delete(s.rules, k)
+			}
+		}
+	}
+	existing, found := s.rules[key]
+	if found {
+		existing.stopExpiryTimer()
+	}
+	if rule.Action == ActionAccept {
+		delete(s.rules, key)
+		return nil
+	}
+	record := existing
+	if !found || existing.Action != rule.Action {
+		id, err := createRandomID()
+		if err != nil {
+			return maskAny(err)
+		}
+		record = &AppliedRule{
+			ID:        id,
+			CreatedAt: time.Now(),
+		}
+		s.rules[key] = record
+	}
+	record.Rule = rule
+	record.class = class
+	record.ExpiresAt = nil
+	if rule.TTL > 0 {
+		expiresAt := time.Now().Add(time.Duration(rule.TTL))
+		record.ExpiresAt = &expiresAt
+		id := record.ID
+		record.expiryTimer = time.AfterFunc(time.Duration(rule.TTL), func() { s.expireRule(key, id) })
+	}
+	return nil
+}
+
+// expireRule removes the rule with given key & ID (but not the rules with the same match
+// and another direction), because its TTL has expired.
+// The timer calling it may fire while the rule is re-applied with a new TTL,
+// so the rule is only removed if its (current) expiry time has passed.
+func (s *Service) expireRule(key, id string) {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	s.mutex.Lock()
+	record, found := s.rules[key]
+	expired := found && record.ID == id && record.ExpiresAt != nil && !time.Now().Before(*record.ExpiresAt)
+	s.mutex.Unlock()
+	if !expired {
+		// Rule has been replaced, removed or extended in the meantime
+		return
+	}
+	s.Logger.Infof("TTL of rule %s (%s) expired", id, record.Rule)
+	if err := s.applyRule(context.Background(), record.Rule.removalRule()); err != nil {
+		s.Logger.Errorf("Failed to remove expired rule %s: %v", id, err)
+	}
+}
+
+// stopExpiryTimers stops the expiry timers of all rules.
+func (s *Service) stopExpiryTimers() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, r := range s.rules {
+		r.stopExpiryTimer()
+	}
+}
+
+// stopExpiryTimer stops the timer that removes the rule when its TTL expires (if any).
+func (r *AppliedRule) stopExpiryTimer() {
+	if r.expiryTimer != nil {
+		r.expiryTimer.Stop()
+		r.expiryTimer = nil
+	}
+}
+
+// ruleCount returns the number of rules applied by this service.
+func (s *Service) ruleCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.rules)
+}
+
+// Rules returns all rules applied by this service, ordered by creation time.
+func (s *Service) Rules() []AppliedRule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	result := make(appliedRulesByCreation, 0, len(s.rules))
+	for _, r := range s.rules {
+		info := *r
+		if info.ExpiresAt != nil {
+			info.Remaining = Duration(info.ExpiresAt.Sub(now))
+		}
+		result = append(result, info)
+	}
+	sort.Sort(result)
+	return result
+}
+
+// appliedRulesByCreation sorts rules by creation time.
+type appliedRulesByCreation []AppliedRule
+
+func (l appliedRulesByCreation) Len() int      { return len(l) }
+func (l appliedRulesByCreation) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l appliedRulesByCreation) Less(i, j int) bool {
+	if l[i].CreatedAt.Equal(l[j].CreatedAt) {
+		return l[i].ID < l[j].ID
+	}
+	return l[i].CreatedAt.Before(l[j].CreatedAt)
+}
+
+// createRandomID returns a random hex encoded ID.
+func createRandomID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", maskAny(err)
+	}
+	return hex.EncodeToString(b), nil
+}
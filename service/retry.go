@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+)
+
+// retry runs the given operation until it succeeds, fails with an error that is not transient,
+// or the given context (limited by the configured operation timeout) is done.
+func (s *Service) retry(ctx context.Context, op func() error) error {
+	if s.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.OperationTimeout)
+		defer cancel()
+	}
+	b := backoff.NewExponentialBackOff()
+	// Retries are bounded by the context
+	b.MaxElapsedTime = 0
+	start := time.Now()
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		} else if !isTransient(err) {
+			return maskAny(err)
+		}
+		s.Logger.Debugf("Operation failed, retrying: %v", err)
+		select {
+		case <-time.After(b.NextBackOff()):
+			// Retry
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				elapsed := time.Since(start) / time.Millisecond * time.Millisecond
+				return timeoutErrorf("Operation did not succeed within %s: %v", elapsed, err)
+			}
+			return maskAny(ctx.Err())
+		}
+	}
+}
+
+// isTransient returns true if the given error may disappear when the failed operation is retried.
+func isTransient(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *iptables.Error:
+		// Exit status 4 indicates a resource problem, such as a busy xtables lock.
+		// Other failures (e.g. a bad rulespec or a missing module) are permanent.
+		return isExitCodeError(cause, 4)
+	case validationError, notFoundError, permanentError:
+		return false
+	default:
+		return true
+	}
+}
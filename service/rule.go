@@ -0,0 +1,334 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Action specifies what happens with traffic that matches a rule.
+type Action string
+
+const (
+	// ActionReject actively denies matching traffic
+	ActionReject Action = "reject"
+	// ActionDrop silently denies matching traffic
+	ActionDrop Action = "drop"
+	// ActionAccept allows matching traffic, by removing a reject, drop or shaping rule with the same match
+	ActionAccept Action = "accept"
+	// ActionLoss silently denies a percentage of matching traffic
+	ActionLoss Action = "loss"
+	// ActionDelay delays matching traffic sent by this host (shaping action)
+	ActionDelay Action = "delay"
+	// ActionThrottle limits the throughput of matching traffic sent by this host (shaping action)
+	ActionThrottle Action = "throttle"
+	// ActionCorrupt corrupts a percentage of matching packets sent by this host (shaping action)
+	ActionCorrupt Action = "corrupt"
+	// ActionDuplicate duplicates a percentage of matching packets sent by this host (shaping action)
+	ActionDuplicate Action = "duplicate"
+	// ActionReorder sends a percentage of matching packets sent by this host ahead of the others,
+	// which are delayed (shaping action)
+	ActionReorder Action = "reorder"
+)
+
+// Rule describes the traffic to match and what to do with it.
+// All match fields are optional, but ports require a protocol.
+type Rule struct {
+	// Protocol to match (tcp|udp)
+	Protocol string `json:"protocol,omitempty"`
+	// Source address or CIDR range to match
+	Source string `json:"src,omitempty"`
+	// Destination address or CIDR range to match
+	Destination string `json:"dst,omitempty"`
+	// Source ports to match
+	SourcePorts Ports `json:"sport,omitempty"`
+	// Destination ports to match
+	DestinationPorts Ports `json:"dport,omitempty"`
+	// Interface via which traffic is received
+	InInterface string `json:"in_intf,omitempty"`
+	// Interface via which traffic is sent
+	OutInterface string `json:"out_intf,omitempty"`
+	// Direction of traffic to match (defaults to both)
+	Direction Direction `json:"direction,omitempty"`
+	// Action to take on matching traffic
+	Action Action `json:"action"`
+	// Percentage of matching packets affected by the action (loss, corrupt, duplicate & reorder actions)
+	Percent float64 `json:"percent,omitempty"`
+	// Selection of the packets dropped by a loss rule (random|nth, defaults to random)
+	Mode LossMode `json:"mode,omitempty"`
+	// Type of response sent by a reject rule (e.g. tcp-reset, defaults to an ICMP port-unreachable message)
+	RejectWith string `json:"with,omitempty"`
+	Shaping
+	RuleOptions
+
+	// exact is set on an accept rule that removes only the rule with the same direction (see removalRule)
+	exact bool
+}
+
+// RuleOptions contains settings of a rule that do not affect the traffic it matches.
+type RuleOptions struct {
+	// Time after which the rule is removed automatically (0 means never)
+	TTL Duration `json:"ttl,omitempty"`
+	// ID of the lease under which the rule is created (if any)
+	Lease string `json:"lease,omitempty"`
+	// Labels attached to the rule by the caller
+	Labels Labels `json:"labels,omitempty"`
+}
+
+// normalize validates the rule and returns a copy with defaults filled in and addresses in CIDR notation,
+// together with the address families the rule applies to.
+func (r Rule) normalize() (Rule, Family, error) {
+	switch r.Protocol {
+	case "":
+		if len(r.SourcePorts) > 0 || len(r.DestinationPorts) > 0 {
+			return r, 0, validationErrorf("Ports require a protocol (tcp|udp)")
+		}
+	case "tcp", "udp":
+		// OK
+	default:
+		return r, 0, validationErrorf("Invalid protocol '%s' (expected tcp|udp)", r.Protocol)
+	}
+	var err error
+	family := FamilyAll
+	for _, addr := range []*string{&r.Source, &r.Destination} {
+		var addrFamily Family
+		if *addr, addrFamily, err = parseAddress(*addr); err != nil {
+			return r, 0, maskAny(err)
+		}
+		family &= addrFamily
+	}
+	if family == 0 {
+		return r, 0, validationErrorf("Source '%s' and destination '%s' have different address families", r.Source, r.Destination)
+	}
+	if r.Direction, err = ParseDirection(string(r.Direction)); err != nil {
+		return r, 0, maskAny(err)
+	}
+	if err := r.Labels.validate(); err != nil {
+		return r, 0, maskAny(err)
+	}
+	switch r.Action {
+	case ActionReject, ActionDrop, ActionAccept, ActionLoss, ActionDelay, ActionThrottle, ActionCorrupt, ActionDuplicate, ActionReorder:
+		// OK
+	default:
+		return r, 0, validationErrorf("Invalid action '%s' (expected reject|drop|loss|accept|delay|throttle|corrupt|duplicate|reorder)", r.Action)
+	}
+	if err := r.validateRejectWith(); err != nil {
+		return r, 0, maskAny(err)
+	}
+	if err := r.validatePercent(); err != nil {
+		return r, 0, maskAny(err)
+	}
+	if err := r.validateLoss(); err != nil {
+		return r, 0, maskAny(err)
+	}
+	if err := r.validateShaping(); err != nil {
+		return r, 0, maskAny(err)
+	}
+	return r, family, nil
+}
+
+// acceptRule returns the accept rule that removes the given rule.
+func (r Rule) acceptRule() Rule {
+	r.Action = ActionAccept
+	r.RejectWith = ""
+	r.Percent = 0
+	r.Mode = ""
+	r.Shaping = Shaping{}
+	r.RuleOptions = RuleOptions{}
+	return r
+}
+
+// removalRule returns the accept rule that removes only the given rule,
+// keeping the rules with the same match but another direction in place.
+func (r Rule) removalRule() Rule {
+	r = r.acceptRule()
+	r.exact = true
+	return r
+}
+
+// String returns a human readable description of the traffic matched by the rule.
+func (r Rule) String() string {
+	var parts []string
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("protocol", r.Protocol)
+	add("src", r.Source)
+	add("dst", r.Destination)
+	if len(r.SourcePorts) > 0 {
+		add("sport", r.SourcePorts.String())
+	}
+	if len(r.DestinationPorts) > 0 {
+		add("dport", r.DestinationPorts.String())
+	}
+	add("in_intf", r.InInterface)
+	add("out_intf", r.OutInterface)
+	add("direction", string(r.Direction))
+	return strings.Join(parts, " ")
+}
+
+// hooks returns the hooks whose chains contain the rule.
+func (r Rule) hooks() []hook {
+	if r.Action.isShaping() {
+		return []hook{markHook}
+	}
+	return r.Direction.hooks()
+}
+
+// createActionSpec returns the rulespec for the given family that applies the action of the rule.
+// Loss rules drop the packets selected by a statistic match,
+// shaping rules mark matching packets for the given traffic control class.
+func (r Rule) createActionSpec(family Family, class int) []string {
+	switch {
+	case r.Action == ActionLoss:
+		spec := append(r.createMatchSpec(), r.createStatisticSpec()...)
+		return append(spec, createTargetSpec(family, r.Protocol, "DROP", "")...)
+	case r.Action.isShaping():
+		return r.createMarkSpec(class)
+	default:
+		return r.createRuleSpec(family, r.Action.target())
+	}
+}
+
+// createRuleSpec returns the rulespec for the given family that jumps to the given target (REJECT|DROP).
+// The REJECT target uses the reject type of the rule.
+func (r Rule) createRuleSpec(family Family, target string) []string {
+	return append(r.createMatchSpec(), createTargetSpec(family, r.Protocol, target, r.RejectWith)...)
+}
+
+// createMatchSpec returns the rulespec arguments that match the traffic of the rule.
+// Rules with direction in or out only match packets sent in the original direction of their connection,
+// so replies to connections opened by this host (in) or by its peers (out) are not affected.
+func (r Rule) createMatchSpec() []string {
+	var spec []string
+	if r.Source != "" {
+		spec = append(spec, "-s", r.Source)
+	}
+	if r.Destination != "" {
+		spec = append(spec, "-d", r.Destination)
+	}
+	if r.InInterface != "" {
+		spec = append(spec, "-i", r.InInterface)
+	}
+	if r.OutInterface != "" {
+		spec = append(spec, "-o", r.OutInterface)
+	}
+	if r.Protocol != "" {
+		spec = append(spec, "-p", r.Protocol)
+	}
+	if len(r.SourcePorts) > 0 {
+		spec = append(spec, r.SourcePorts.createMatchSpec(r.Protocol, "s")...)
+	}
+	if len(r.DestinationPorts) > 0 {
+		spec = append(spec, r.DestinationPorts.createMatchSpec(r.Protocol, "d")...)
+	}
+	if (r.Direction == DirectionIn || r.Direction == DirectionOut) && !r.Action.isShaping() {
+		spec = append(spec, "-m", "conntrack", "--ctdir", "ORIGINAL")
+	}
+	return spec
+}
+
+// ParsePercent parses a percentage such as "10" or "0.5".
+// An empty value results in 0.
+func ParsePercent(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, validationErrorf("Invalid percentage '%s' (expected a number between 0 and 100)", value)
+	}
+	return percent, nil
+}
+
+// validatePercent returns an error if the percentage does not fit the action of the rule.
+func (r Rule) validatePercent() error {
+	if !r.Action.hasPercent() {
+		if r.Percent != 0 {
+			return validationErrorf("Parameter 'percent' is not supported by action '%s'", r.Action)
+		}
+		return nil
+	}
+	if r.Percent <= 0 || r.Percent > 100 {
+		return validationErrorf("Action '%s' requires a percentage between 0 and 100", r.Action)
+	}
+	return nil
+}
+
+// hasPercent returns true if the action applies to a percentage of matching packets.
+func (a Action) hasPercent() bool {
+	switch a {
+	case ActionLoss, ActionCorrupt, ActionDuplicate, ActionReorder:
+		return true
+	default:
+		return false
+	}
+}
+
+// target returns the iptables target of the rule's deny action (loss rules drop packets).
+func (a Action) target() string {
+	if a == ActionReject {
+		return "REJECT"
+	}
+	return "DROP"
+}
+
+// otherDenyTargets returns the targets of deny actions that are replaced by the given action.
+func (a Action) otherDenyTargets() []string {
+	switch a {
+	case ActionReject:
+		return []string{"DROP"}
+	case ActionDrop:
+		return []string{"REJECT"}
+	default:
+		return []string{"REJECT", "DROP"}
+	}
+}
+
+// validateRejectWith returns an error if the reject type is unknown or does not fit the action & protocol of the rule.
+func (r Rule) validateRejectWith() error {
+	if r.RejectWith == "" {
+		return nil
+	}
+	if r.Action != ActionReject {
+		return validationErrorf("Parameter 'with' is not supported by action '%s'", r.Action)
+	}
+	if _, found := ipv6RejectTypes[r.RejectWith]; !found {
+		return validationErrorf("Invalid reject type '%s' (expected tcp-reset|icmp-port-unreachable|icmp-host-unreachable|icmp-net-unreachable|icmp-admin-prohibited)", r.RejectWith)
+	}
+	if r.RejectWith == "tcp-reset" && r.Protocol != "tcp" {
+		return validationErrorf("Reject type '%s' requires protocol tcp", r.RejectWith)
+	}
+	return nil
+}
+
+var (
+	// ipv6RejectTypes maps the reject types supported by rules to the corresponding ip6tables reject types.
+	ipv6RejectTypes = map[string]string{
+		"tcp-reset":             "tcp-reset",
+		"icmp-port-unreachable": "icmp6-port-unreachable",
+		"icmp-host-unreachable": "icmp6-addr-unreachable",
+		"icmp-net-unreachable":  "icmp6-no-route",
+		"icmp-admin-prohibited": "icmp6-adm-prohibited",
+	}
+)
+
+// createTargetSpec returns the rulespec arguments that jump to the given target.
+// REJECT uses the given reject type. Without reject type, UDP traffic is rejected with an ICMP port-unreachable message.
+func createTargetSpec(family Family, protocol, target, with string) []string {
+	spec := []string{"-j", target}
+	if target != "REJECT" {
+		return spec
+	}
+	if with == "" && protocol == "udp" {
+		with = "icmp-port-unreachable"
+	}
+	if with != "" {
+		if family == FamilyIPv6 {
+			with = ipv6RejectTypes[with]
+		}
+		spec = append(spec, "--reject-with", with)
+	}
+	return spec
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRejectWith(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		err  bool
+	}{
+		{rule: Rule{Protocol: "tcp", Action: ActionReject}},
+		{rule: Rule{Protocol: "tcp", Action: ActionReject, RejectWith: "tcp-reset"}},
+		{rule: Rule{Protocol: "udp", Action: ActionReject, RejectWith: "tcp-reset"}, err: true},
+		{rule: Rule{Action: ActionReject, RejectWith: "tcp-reset"}, err: true},
+		{rule: Rule{Protocol: "udp", Action: ActionReject, RejectWith: "icmp-port-unreachable"}},
+		{rule: Rule{Action: ActionReject, RejectWith: "icmp-host-unreachable"}},
+		{rule: Rule{Action: ActionReject, RejectWith: "icmp-net-unreachable"}},
+		{rule: Rule{Action: ActionReject, RejectWith: "icmp-admin-prohibited"}},
+		{rule: Rule{Action: ActionReject, RejectWith: "icmp6-port-unreachable"}, err: true},
+		{rule: Rule{Action: ActionReject, RejectWith: "nothing"}, err: true},
+		{rule: Rule{Protocol: "tcp", Action: ActionDrop, RejectWith: "tcp-reset"}, err: true},
+		{rule: Rule{Action: ActionAccept, RejectWith: "icmp-port-unreachable"}, err: true},
+	}
+	for _, test := range tests {
+		err := test.rule.validateRejectWith()
+		switch {
+		case test.err && !IsValidation(err):
+			t.Errorf("validateRejectWith(%+v): expected validation error, got %v", test.rule, err)
+		case !test.err && err != nil:
+			t.Errorf("validateRejectWith(%+v): unexpected error: %v", test.rule, err)
+		}
+	}
+}
+
+func TestCreateTargetSpec(t *testing.T) {
+	tests := []struct {
+		family   Family
+		protocol string
+		target   string
+		with     string
+		expected string
+	}{
+		{family: FamilyIPv4, protocol: "tcp", target: "DROP", expected: "-j DROP"},
+		{family: FamilyIPv4, protocol: "udp", target: "DROP", with: "icmp-port-unreachable", expected: "-j DROP"},
+		{family: FamilyIPv4, protocol: "tcp", target: "REJECT", expected: "-j REJECT"},
+		{family: FamilyIPv4, protocol: "", target: "REJECT", expected: "-j REJECT"},
+		{family: FamilyIPv4, protocol: "udp", target: "REJECT", expected: "-j REJECT --reject-with icmp-port-unreachable"},
+		{family: FamilyIPv6, protocol: "udp", target: "REJECT", expected: "-j REJECT --reject-with icmp6-port-unreachable"},
+		{family: FamilyIPv4, protocol: "tcp", target: "REJECT", with: "tcp-reset", expected: "-j REJECT --reject-with tcp-reset"},
+		{family: FamilyIPv6, protocol: "tcp", target: "REJECT", with: "tcp-reset", expected: "-j REJECT --reject-with tcp-reset"},
+		{family: FamilyIPv4, protocol: "udp", target: "REJECT", with: "icmp-host-unreachable", expected: "-j REJECT --reject-with icmp-host-unreachable"},
+		{family: FamilyIPv6, protocol: "udp", target: "REJECT", with: "icmp-host-unreachable", expected: "-j REJECT --reject-with icmp6-addr-unreachable"},
+		{family: FamilyIPv6, protocol: "", target: "REJECT", with: "icmp-net-unreachable", expected: "-j REJECT --reject-with icmp6-no-route"},
+		{family: FamilyIPv6, protocol: "", target: "REJECT", with: "icmp-admin-prohibited", expected: "-j REJECT --reject-with icmp6-adm-prohibited"},
+		{family: FamilyAll, protocol: "", target: "REJECT", with: "icmp-admin-prohibited", expected: "-j REJECT --reject-with icmp-admin-prohibited"},
+	}
+	for _, test := range tests {
+		spec := strings.Join(createTargetSpec(test.family, test.protocol, test.target, test.with), " ")
+		if spec != test.expected {
+			t.Errorf("createTargetSpec(%s, %q, %s, %q): expected %q, got %q", test.family, test.protocol, test.target, test.with, test.expected, spec)
+		}
+	}
+}
+
+func TestCreateActionSpec(t *testing.T) {
+	tests := []struct {
+		rule     Rule
+		family   Family
+		class    int
+		expected string
+	}{
+		{
+			rule:     Rule{Protocol: "tcp", DestinationPorts: Ports{{8529, 8529}}, Direction: DirectionBoth, Action: ActionDrop},
+			expected: "-p tcp -m tcp --dport 8529 -j DROP",
+		},
+		{
+			rule:     Rule{Protocol: "udp", DestinationPorts: Ports{{8529, 8539}}, Direction: DirectionIn, Action: ActionReject},
+			expected: "-p udp -m multiport --dports 8529:8539 -m conntrack --ctdir ORIGINAL -j REJECT --reject-with icmp-port-unreachable",
+		},
+		{
+			rule:     Rule{Source: "10.0.0.5/32", InInterface: "eth0", Direction: DirectionIn, Action: ActionDrop},
+			expected: "-s 10.0.0.5/32 -i eth0 -m conntrack --ctdir ORIGINAL -j DROP",
+		},
+		{
+			rule:     Rule{Destination: "fd00::1/128", Direction: DirectionOut, Action: ActionReject, RejectWith: "icmp-admin-prohibited"},
+			family:   FamilyIPv6,
+			expected: "-d fd00::1/128 -m conntrack --ctdir ORIGINAL -j REJECT --reject-with icmp6-adm-prohibited",
+		},
+		{
+			rule:     Rule{Source: "10.0.0.5/32", Direction: DirectionBoth, Action: ActionLoss, Percent: 25, Mode: LossNth},
+			expected: "-s 10.0.0.5/32 -m statistic --mode nth --every 4 --packet 0 -j DROP",
+		},
+		{
+			rule:     Rule{Protocol: "tcp", DestinationPorts: Ports{{8529, 8529}}, Direction: DirectionOut, Action: ActionDelay},
+			class:    4,
+			expected: "-p tcp -m tcp --dport 8529 -j MARK --set-xmark 0x4000000/0x1f000000",
+		},
+	}
+	for _, test := range tests {
+		family := test.family
+		if family == 0 {
+			family = FamilyIPv4
+		}
+		if spec := strings.Join(test.rule.createActionSpec(family, test.class), " "); spec != test.expected {
+			t.Errorf("createActionSpec(%+v): expected %q, got %q", test.rule, test.expected, spec)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// RuleSet is a named group of rules that is activated & deactivated as a whole.
+// The rules of a set are kept in chains of their own (one for each hook),
+// which are jumped to from the chains of the service while the set is active.
+type RuleSet struct {
+	// Name of the set, unique within the service
+	Name string `json:"name"`
+	// Rules of the set (reject or drop only)
+	Rules []Rule `json:"rules"`
+	// Set if the rules of the set are enforced
+	Active bool `json:"active"`
+
+	chainID  int
+	families []Family
+}
+
+var (
+	ruleSetNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// PutRuleSet creates the rule set with given name, or replaces the rules of an existing set.
+// Replacing the rules of an active set is atomic, the set remains active.
+func (s *Service) PutRuleSet(ctx context.Context, name string, rules []Rule) error {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	return maskAny(s.putRuleSet(ctx, name, rules, false))
+}
+
+// putRuleSet creates or replaces the rule set with given name.
+// If activate is set, a new set is activated right away.
+// The mutation mutex must be held.
+func (s *Service) putRuleSet(ctx context.Context, name string, rules []Rule, activate bool) error {
+	if !ruleSetNamePattern.MatchString(name) {
+		return validationErrorf("Invalid rule set name '%s' (expected at most 64 letters, digits, '_', '.' or '-')", name)
+	}
+	set := &RuleSet{
+		Name: name,
+	}
+	for i, rule := range rules {
+		rule, family, err := rule.normalize()
+		if err != nil {
+			return validationErrorf("Rule %d: %v", i+1, err)
+		}
+		if rule.Action != ActionReject && rule.Action != ActionDrop {
+			return validationErrorf("Rule %d: Rule sets can only contain reject or drop rules", i+1)
+		}
+		if rule.TTL != 0 || rule.Lease != "" || len(rule.Labels) > 0 {
+			return validationErrorf("Rule %d: Rule options (ttl, lease, labels) are not supported in rule sets", i+1)
+		}
+		set.Rules = append(set.Rules, rule)
+		set.families = append(set.families, family)
+	}
+
+	s.mutex.Lock()
+	existing := s.sets[name]
+	set.chainID = s.nextSetChainID
+	s.nextSetChainID++
+	s.mutex.Unlock()
+	set.Active = activate || (existing != nil && existing.Active)
+
+	// Fill the chains of the new set & (if active) replace the jumps to the chains of the existing set
+	var applied []*ruleBatch
+	for _, c := range s.clients {
+		batch := &ruleBatch{client: c}
+		op := func() error {
+			batch.changes = nil
+			for _, h := range allHooks {
+				if err := c.ClearChain(h.table, s.setChainName(set, h)); err != nil {
+					return maskAny(err)
+				}
+			}
+			// Rules are inserted at the top, so insert them in reverse order
+			for i := len(set.Rules) - 1; i >= 0; i-- {
+				rule := set.Rules[i]
+				if c.family&set.families[i] == 0 {
+					continue
+				}
+				ruleSpec := rule.createRuleSpec(c.family, rule.Action.target())
+				for _, h := range rule.Direction.hooks() {
+					batch.changes = append(batch.changes, RuleChange{Table: h.table, Chain: s.setChainName(set, h), RuleSpec: ruleSpec})
+				}
+			}
+			if set.Active {
+				for _, h := range allHooks {
+					chain := h.chainName(s.chainName)
+					batch.changes = append(batch.changes, RuleChange{Table: h.table, Chain: chain, RuleSpec: []string{"-j", s.setChainName(set, h)}})
+					if existing != nil && existing.Active {
+						batch.changes = append(batch.changes, RuleChange{Delete: true, Table: h.table, Chain: chain, RuleSpec: []string{"-j", s.setChainName(existing, h)}})
+					}
+				}
+			}
+			return maskAny(c.ApplyBatch(batch.changes))
+		}
+		if err := s.retry(ctx, op); err != nil {
+			s.Logger.Errorf("Failed to create %s chains of rule set '%s': %v", c.family, name, err)
+			s.rollback(applied)
+			s.removeRuleSetChains(set)
+			return maskAny(err)
+		}
+		applied = append(applied, batch)
+	}
+
+	s.mutex.Lock()
+	s.sets[name] = set
+	s.mutex.Unlock()
+	if existing != nil {
+		s.removeRuleSetChains(existing)
+	}
+	s.Logger.Infof("Stored rule set '%s' with %d rules (active: %v)", name, len(set.Rules), set.Active)
+	s.saveState()
+	return nil
+}
+
+// ActivateRuleSet starts enforcing the rules of the set with given name.
+func (s *Service) ActivateRuleSet(ctx context.Context, name string) error {
+	return maskAny(s.setRuleSetActive(ctx, name, true))
+}
+
+// DeactivateRuleSet stops enforcing the rules of the set with given name.
+func (s *Service) DeactivateRuleSet(ctx context.Context, name string) error {
+	return maskAny(s.setRuleSetActive(ctx, name, false))
+}
+
+// setRuleSetActive adds or removes the jumps to the chains of the set with given name.
+func (s *Service) setRuleSetActive(ctx context.Context, name string, active bool) error {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	s.mutex.Lock()
+	set, found := s.sets[name]
+	s.mutex.Unlock()
+	if !found {
+		return notFoundErrorf("Rule set '%s' not found", name)
+	}
+	if err := s.applyRuleSetJumps(ctx, set, active); err != nil {
+		return maskAny(err)
+	}
+	s.mutex.Lock()
+	set.Active = active
+	s.mutex.Unlock()
+	if active {
+		s.Logger.Infof("Activated rule set '%s'", name)
+	} else {
+		s.Logger.Infof("Deactivated rule set '%s'", name)
+	}
+	s.saveState()
+	return nil
+}
+
+// DeleteRuleSet deactivates & removes the rule set with given name.
+func (s *Service) DeleteRuleSet(ctx context.Context, name string) error {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	s.mutex.Lock()
+	set, found := s.sets[name]
+	s.mutex.Unlock()
+	if !found {
+		return notFoundErrorf("Rule set '%s' not found", name)
+	}
+	if err := s.applyRuleSetJumps(ctx, set, false); err != nil {
+		return maskAny(err)
+	}
+	s.mutex.Lock()
+	delete(s.sets, name)
+	s.mutex.Unlock()
+	s.removeRuleSetChains(set)
+	s.Logger.Infof("Deleted rule set '%s'", name)
+	s.saveState()
+	return nil
+}
+
+// RuleSets returns all rule sets, ordered by name.
+func (s *Service) RuleSets() []RuleSet {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0, len(s.sets))
+	for name := range s.sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]RuleSet, 0, len(names))
+	for _, name := range names {
+		result = append(result, *s.sets[name])
+	}
+	return result
+}
+
+// applyRuleSetJumps adds (active) or removes (!active) the jumps from the chains of the service
+// to the chains of the given set, in a single transaction per backend.
+// The mutation mutex must be held.
+func (s *Service) applyRuleSetJumps(ctx context.Context, set *RuleSet, active bool) error {
+	var applied []*ruleBatch
+	for _, c := range s.clients {
+		var batch *ruleBatch
+		op := func() error {
+			batch = newRuleBatch(c)
+			for _, h := range allHooks {
+				chain := h.chainName(s.chainName)
+				jump := []string{"-j", s.setChainName(set, h)}
+				var err error
+				if active {
+					err = batch.insert(h.table, chain, jump)
+				} else {
+					err = batch.delete(h.table, chain, jump)
+				}
+				if err != nil {
+					return maskAny(err)
+				}
+			}
+			return maskAny(c.ApplyBatch(batch.changes))
+		}
+		if err := s.retry(ctx, op); err != nil {
+			s.Logger.Errorf("Failed to change %s jumps to rule set '%s': %v", c.family, set.Name, err)
+			s.rollback(applied)
+			return maskAny(err)
+		}
+		applied = append(applied, batch)
+	}
+	return nil
+}
+
+// removeRuleSetChains removes the (no longer referenced) chains of the given set.
+// Failures are logged only.
+func (s *Service) removeRuleSetChains(set *RuleSet) {
+	for _, c := range s.clients {
+		for _, h := range allHooks {
+			chain := s.setChainName(set, h)
+			if err := c.ClearChain(h.table, chain); err != nil {
+				s.Logger.Warningf("Failed to clear %s '%s' chain: %v", c.family, chain, err)
+			}
+			if err := c.DeleteChain(h.table, chain); err != nil {
+				s.Logger.Warningf("Failed to remove %s '%s' chain: %v", c.family, chain, err)
+			}
+		}
+	}
+}
+
+// setChainName returns the name of the chain containing the rules of the given set for the given hook.
+func (s *Service) setChainName(set *RuleSet, h hook) string {
+	return h.chainName(fmt.Sprintf("%s-S%d", s.chainName, set.chainID))
+}
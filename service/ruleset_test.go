@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestRuleSet checks the chains & jumps of a rule set while it is created, activated, replaced,
+// deactivated and deleted.
+func TestRuleSet(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	// setChains returns the chain of the current version of the rule set with given name for every hook.
+	setChains := func(name string) map[hook]string {
+		result := make(map[hook]string)
+		for _, set := range s.RuleSets() {
+			if set.Name == name {
+				for _, h := range allHooks {
+					result[h] = s.setChainName(&set, h)
+				}
+			}
+		}
+		return result
+	}
+
+	if err := s.PutRuleSet(ctx, "db2", []Rule{
+		{Source: "10.0.0.2", Direction: DirectionIn, Action: ActionDrop},
+		{Protocol: "tcp", DestinationPorts: Ports{{8529, 8529}}, Action: ActionReject},
+	}); err != nil {
+		t.Fatalf("PutRuleSet failed: %v", err)
+	}
+	v1 := setChains("db2")
+	reject := "-p tcp -m tcp --dport 8529 -j REJECT"
+	expectRules(t, backend, filterTable, v1[inputHook], "-s 10.0.0.2/32 -m conntrack --ctdir ORIGINAL -j DROP", reject)
+	expectRules(t, backend, filterTable, v1[forwardHook], reject)
+	expectRules(t, backend, filterTable, v1[outputHook], reject)
+	// A new set is inactive
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.chainName(s.chainName))
+	}
+
+	if err := s.ActivateRuleSet(ctx, "db2"); err != nil {
+		t.Fatalf("ActivateRuleSet failed: %v", err)
+	}
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.chainName(s.chainName), "-j "+v1[h])
+	}
+
+	// Replacing the rules of an active set keeps it active & removes the chains of the old rules
+	if err := s.PutRuleSet(ctx, "db2", []Rule{{Source: "10.0.0.3", Direction: DirectionOut, Action: ActionDrop}}); err != nil {
+		t.Fatalf("PutRuleSet failed: %v", err)
+	}
+	v2 := setChains("db2")
+	if sets := s.RuleSets(); len(sets) != 1 || !sets[0].Active || len(sets[0].Rules) != 1 {
+		t.Errorf("Expected 1 active rule set with 1 rule, got %+v", sets)
+	}
+	expectRules(t, backend, filterTable, v2[inputHook])
+	expectRules(t, backend, filterTable, v2[outputHook], "-s 10.0.0.3/32 -m conntrack --ctdir ORIGINAL -j DROP")
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.chainName(s.chainName), "-j "+v2[h])
+	}
+	for _, chain := range serviceChains(t, backend) {
+		for _, h := range allHooks {
+			if chain == v1[h] {
+				t.Errorf("Expected chain %s to be removed", chain)
+			}
+		}
+	}
+
+	if err := s.DeactivateRuleSet(ctx, "db2"); err != nil {
+		t.Fatalf("DeactivateRuleSet failed: %v", err)
+	}
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.chainName(s.chainName))
+	}
+	if err := s.ActivateRuleSet(ctx, "db3"); !IsNotFound(err) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+
+	if err := s.ActivateRuleSet(ctx, "db2"); err != nil {
+		t.Fatalf("ActivateRuleSet failed: %v", err)
+	}
+	if err := s.DeleteRuleSet(ctx, "db2"); err != nil {
+		t.Fatalf("DeleteRuleSet failed: %v", err)
+	}
+	if sets := s.RuleSets(); len(sets) != 0 {
+		t.Errorf("Expected no rule sets, got %+v", sets)
+	}
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.chainName(s.chainName))
+	}
+	for _, chain := range serviceChains(t, backend) {
+		if strings.HasPrefix(chain, s.chainName+"-S") {
+			t.Errorf("Expected chain %s to be removed", chain)
+		}
+	}
+}
+
+// TestPutRuleSetValidation checks that invalid rule sets are rejected.
+func TestPutRuleSetValidation(t *testing.T) {
+	s, _ := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	drop := Rule{Source: "10.0.0.2", Action: ActionDrop}
+	tests := []struct {
+		name  string
+		rules []Rule
+	}{
+		{name: "bad name", rules: []Rule{drop}},
+		{name: "db2", rules: []Rule{{Source: "10.0.0.2", Action: ActionAccept}}},
+		{name: "db2", rules: []Rule{{Source: "10.0.0.2", Action: ActionDrop, RuleOptions: RuleOptions{TTL: 1}}}},
+		{name: "db2", rules: []Rule{drop, {Source: "10.0.0.256", Action: ActionDrop}}},
+	}
+	for _, test := range tests {
+		if err := s.PutRuleSet(ctx, test.name, test.rules); !IsValidation(err) {
+			t.Errorf("PutRuleSet(%s, %+v): expected validation error, got %v", test.name, test.rules, err)
+		}
+	}
+	if sets := s.RuleSets(); len(sets) != 0 {
+		t.Errorf("Expected no rule sets, got %+v", sets)
+	}
+}
@@ -1,296 +1,546 @@
 package service
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"fmt"
-	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/cenkalti/backoff"
 	"github.com/coreos/go-iptables/iptables"
 	logging "github.com/op/go-logging"
 	"github.com/pkg/errors"
 )
 
 type ServiceConfig struct {
+	// BackendType selects the firewall backend (iptables|nftables).
+	// Ignored when a Backend is given as dependency.
+	BackendType string
+	// Orphans selects what happens with chains left behind by previous instances (delete|adopt).
+	Orphans string
+	// StateFile is the path of a file used to persist applied rules & leases across restarts (optional).
+	StateFile string
+	// OperationTimeout limits the time spent retrying a single operation (0 means no limit).
+	OperationTimeout time.Duration
+	// ReconcileInterval is the interval at which chains & rules are checked for drift (0 disables reconciliation).
+	ReconcileInterval time.Duration
+	// TCDevice is the network device via which traffic is shaped by shaping rules (optional).
+	// Ignored when a Shaper is given as dependency.
+	TCDevice string
 }
 
 type ServiceDependencies struct {
 	Logger *logging.Logger
+	// Backend used to enforce rules. If nil, backends of the configured type are created.
+	// Unless IPv6Backend is also set, this backend must handle both IPv4 & IPv6.
+	Backend Backend
+	// IPv6Backend is used to enforce IPv6 rules (if set, Backend is used for IPv4 only).
+	IPv6Backend Backend
+	// Shaper used to shape traffic marked by shaping rules. If nil, a tc shaper is created
+	// for the configured device. If there is no such device, shaping rules are not supported.
+	Shaper Shaper
 }
 
 type Service struct {
 	ServiceConfig
 	ServiceDependencies
 
-	client    *iptables.IPTables
+	clients   []client
 	chainName string
+
+	// mutationMutex serializes all changes to the chains & the desired state
+	mutationMutex sync.Mutex
+
+	mutex  sync.Mutex
+	rules  map[string]*AppliedRule
+	leases map[string]*Lease
+	sets   map[string]*RuleSet
+
+	nextSetChainID int
+	// restoring is set while the state file is restored
+	restoring bool
+
+	stateMutex    sync.Mutex
+	driftEvents   []DriftEvent
+	reconcileStop chan struct{}
+	reconcileDone chan struct{}
+}
+
+// client is a backend responsible for one or more address families.
+type client struct {
+	Backend
+	family Family
 }
 
 const (
 	filterTable = "filter"
+	mangleTable = "mangle"
+)
+
+var (
+	// serviceTables are the tables that contain chains of the service
+	serviceTables = []string{filterTable, mangleTable}
 )
 
 // NewService creates a new Service from given config & dependencies
 func NewService(config ServiceConfig, deps ServiceDependencies) (*Service, error) {
-	client, err := iptables.New()
+	// Create random ID
+	id, err := createRandomID()
 	if err != nil {
 		return nil, maskAny(err)
 	}
+	chainName := fmt.Sprintf("NETBLK-%s", id)
 
-	// Create random ID
-	b := make([]byte, 4)
-	if _, err := rand.Read(b); err != nil {
+	clients, err := createClients(config, deps, chainName)
+	if err != nil {
 		return nil, maskAny(err)
 	}
-	id := hex.EncodeToString(b)
+	switch config.Orphans {
+	case "", OrphansDelete, OrphansAdopt:
+		// OK
+	default:
+		return nil, maskAny(fmt.Errorf("Unknown orphans mode '%s'", config.Orphans))
+	}
+	if deps.Shaper == nil && config.TCDevice != "" {
+		if deps.Shaper, err = NewTCShaper(config.TCDevice); err != nil {
+			return nil, maskAny(err)
+		}
+	}
 
 	s := &Service{
 		ServiceConfig:       config,
 		ServiceDependencies: deps,
-		client:              client,
-		chainName:           fmt.Sprintf("NETBLK-%s", id),
+		clients:             clients,
+		chainName:           chainName,
+		rules:               make(map[string]*AppliedRule),
+		leases:              make(map[string]*Lease),
+		sets:                make(map[string]*RuleSet),
 	}
 	return s, nil
 }
 
-// Initialize initializes an iptables chain for this service.
-func (s *Service) Initialize() error {
-	op := func() error {
-		if err := s.client.ClearChain(filterTable, s.chainName); err != nil {
-			return maskAny(err)
-		}
-		if err := s.client.Append(filterTable, s.chainName, "-j", "RETURN"); err != nil {
-			return maskAny(err)
-		}
-		if err := s.client.Insert(filterTable, "INPUT", 1, "-j", s.chainName); err != nil {
-			return maskAny(err)
+// createClients creates the backends used by a service with given base chain name.
+func createClients(config ServiceConfig, deps ServiceDependencies, chainName string) ([]client, error) {
+	var clients []client
+	switch {
+	case deps.Backend != nil && deps.IPv6Backend != nil:
+		clients = []client{{deps.Backend, FamilyIPv4}, {deps.IPv6Backend, FamilyIPv6}}
+	case deps.Backend != nil:
+		clients = []client{{deps.Backend, FamilyAll}}
+	case config.BackendType == "" || config.BackendType == BackendIPTables:
+		ipv4, err := NewIPTablesBackend(FamilyIPv4)
+		if err != nil {
+			return nil, maskAny(err)
 		}
-		if err := s.client.Insert(filterTable, "FORWARD", 1, "-j", s.chainName); err != nil {
-			return maskAny(err)
+		clients = append(clients, client{ipv4, FamilyIPv4})
+		if ipv6, err := NewIPTablesBackend(FamilyIPv6); err != nil {
+			deps.Logger.Warningf("IPv6 is not supported, blocking IPv4 traffic only: %v", err)
+		} else {
+			clients = append(clients, client{ipv6, FamilyIPv6})
 		}
-		if err := s.client.Insert(filterTable, "OUTPUT", 1, "-j", s.chainName); err != nil {
-			return maskAny(err)
+	case config.BackendType == BackendNFTables:
+		backend, err := NewNFTablesBackend(strings.ToLower(chainName))
+		if err != nil {
+			return nil, maskAny(err)
 		}
-		return nil
-	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
-		return maskAny(err)
+		clients = []client{{backend, FamilyAll}}
+	default:
+		return nil, maskAny(fmt.Errorf("Unknown backend '%s'", config.BackendType))
 	}
-	return nil
+	return clients, nil
 }
 
-// Cleanup removes all generated iptables chain & rules made by this service.
-func (s *Service) Cleanup() error {
-	if err := s.client.Delete(filterTable, "INPUT", "-j", s.chainName); err != nil {
-		s.Logger.Warningf("Failed to remove INPUT chain rule: %v", err)
-	}
-	if err := s.client.Delete(filterTable, "FORWARD", "-j", s.chainName); err != nil {
-		s.Logger.Warningf("Failed to remove FORWARD chain rule: %v", err)
-	}
-	if err := s.client.Delete(filterTable, "OUTPUT", "-j", s.chainName); err != nil {
-		s.Logger.Warningf("Failed to remove OUTPUT chain rule: %v", err)
-	}
-	if err := s.client.ClearChain(filterTable, s.chainName); err != nil {
-		s.Logger.Warningf("Failed to clear '%s' chain: %v", s.chainName, err)
-	}
-	if err := s.client.DeleteChain(filterTable, s.chainName); err != nil {
-		s.Logger.Warningf("Failed to remove '%s' chain: %v", s.chainName, err)
+// Initialize initializes the iptables chains for this service, one for each hook.
+// Chains left behind by previous instances are removed or adopted first.
+// If traffic shaping is configured, the root qdisc of the shaper is installed.
+// Afterwards, the rules found in the state file (if any) are re-applied
+// and the reconciler is started.
+func (s *Service) Initialize() error {
+	adopted, err := s.handleOrphans()
+	if err != nil {
+		return maskAny(err)
 	}
-	return nil
-}
-
-// RejectTCP actively denies all traffic on the given TCP port
-func (s *Service) RejectTCP(port int) error {
-	op := func() error {
-		ruleBuilder := func(action string) []string { return createPortRuleSpec(port, action) }
-		if err := s.removeRuleSpecs(ruleBuilder, "DROP"); err != nil {
-			return maskAny(err)
-		}
-		ruleSpec := createPortRuleSpec(port, "REJECT")
-		if found, err := s.client.Exists(filterTable, s.chainName, ruleSpec...); err != nil {
-			s.Logger.Errorf("Failed to check existance of rulespec %q: %v", ruleSpec, err)
-			return maskAny(err)
-		} else if !found {
-			s.Logger.Infof("Denying traffic to TCP port %d", port)
-			if err := s.client.Insert(filterTable, s.chainName, 1, ruleSpec...); err != nil {
-				s.Logger.Errorf("Failed to deny traffic to TCP port %d: %v", port, err)
+	op := func(c client) error {
+		chains := make(map[string][]string)
+		for _, h := range s.hooks() {
+			if _, found := chains[h.table]; !found {
+				list, err := c.ListChains(h.table)
+				if err != nil {
+					return maskAny(err)
+				}
+				chains[h.table] = list
+			}
+			chain := h.chainName(s.chainName)
+			if !adopted || !containsString(chains[h.table], chain) {
+				if err := c.ClearChain(h.table, chain); err != nil {
+					return maskAny(err)
+				}
+				if err := c.Append(h.table, chain, "-j", "RETURN"); err != nil {
+					return maskAny(err)
+				}
+			}
+			if found, err := c.Exists(h.table, h.builtin, "-j", chain); err != nil {
 				return maskAny(err)
+			} else if !found {
+				if err := c.Insert(h.table, h.builtin, 1, "-j", chain); err != nil {
+					return maskAny(err)
+				}
 			}
 		}
 		return nil
 	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
+	if err := s.forEachClient(context.Background(), FamilyAll, op); err != nil {
 		return maskAny(err)
 	}
-	return nil
-}
-
-// DropTCP silently denies all traffic on the given TCP port
-func (s *Service) DropTCP(port int) error {
-	op := func() error {
-		ruleBuilder := func(action string) []string { return createPortRuleSpec(port, action) }
-		if err := s.removeRuleSpecs(ruleBuilder, "REJECT"); err != nil {
-			return maskAny(err)
-		}
-		ruleSpec := createPortRuleSpec(port, "DROP")
-		s.Logger.Infof("Denying traffic to TCP port %d", port)
-		if found, err := s.client.Exists(filterTable, s.chainName, ruleSpec...); err != nil {
-			s.Logger.Errorf("Failed to check existance of rulespec %q: %v", ruleSpec, err)
+	if s.Shaper != nil {
+		if err := s.retry(context.Background(), s.Shaper.Setup); err != nil {
 			return maskAny(err)
-		} else if !found {
-			if err := s.client.Insert(filterTable, s.chainName, 1, ruleSpec...); err != nil {
-				s.Logger.Errorf("Failed to deny traffic to TCP port %d: %v", port, err)
-				return maskAny(err)
-			}
 		}
-		return nil
 	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
+	if err := s.restoreState(); err != nil {
 		return maskAny(err)
 	}
+	s.startReconciler()
 	return nil
 }
 
-// AcceptTCP allow all traffic on the given TCP port
-func (s *Service) AcceptTCP(port int) error {
-	op := func() error {
-		s.Logger.Infof("Accepting traffic to TCP port %d", port)
-		ruleBuilder := func(action string) []string { return createPortRuleSpec(port, action) }
-		if err := s.removeRuleSpecs(ruleBuilder, "REJECT", "DROP"); err != nil {
-			return maskAny(err)
+// Cleanup removes all generated iptables chain & rules made by this service.
+func (s *Service) Cleanup() error {
+	s.stopReconciler()
+	s.stopExpiryTimers()
+	s.stopLeaseTimers()
+
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	for _, c := range s.clients {
+		for _, h := range s.hooks() {
+			chain := h.chainName(s.chainName)
+			if err := c.Delete(h.table, h.builtin, "-j", chain); err != nil {
+				s.Logger.Warningf("Failed to remove %s %s chain rule: %v", c.family, h.builtin, err)
+			}
+			if err := c.ClearChain(h.table, chain); err != nil {
+				s.Logger.Warningf("Failed to clear %s '%s' chain: %v", c.family, chain, err)
+			}
+			if err := c.DeleteChain(h.table, chain); err != nil {
+				s.Logger.Warningf("Failed to remove %s '%s' chain: %v", c.family, chain, err)
+			}
 		}
-		return nil
 	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
-		return maskAny(err)
+	// The chains of rule sets are no longer referenced now
+	for _, set := range s.sets {
+		s.removeRuleSetChains(set)
+	}
+	if s.Shaper != nil {
+		if err := s.Shaper.Teardown(); err != nil {
+			s.Logger.Warningf("Failed to remove traffic control qdisc: %v", err)
+		}
 	}
 	return nil
 }
 
-// RejectAllFrom actively denies all traffic coming from the given IP address on the given interface
-func (s *Service) RejectAllFrom(ip, intf string) error {
-	op := func() error {
-		ruleBuilder := func(action string) []string { return createSourceRuleSpec(ip, intf, action) }
-		if err := s.removeRuleSpecs(ruleBuilder, "DROP"); err != nil {
+// RejectTCP actively denies all traffic on the given TCP ports in the given direction,
+// using the given reject type (optional)
+func (s *Service) RejectTCP(ctx context.Context, ports Ports, dir Direction, with string, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionReject, RejectWith: with, RuleOptions: opts}))
+}
+
+// DropTCP silently denies all traffic on the given TCP ports in the given direction
+func (s *Service) DropTCP(ctx context.Context, ports Ports, dir Direction, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionDrop, RuleOptions: opts}))
+}
+
+// AcceptTCP allow all traffic on the given TCP ports in the given direction
+func (s *Service) AcceptTCP(ctx context.Context, ports Ports, dir Direction) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionAccept}))
+}
+
+// RejectUDP actively denies all traffic on the given UDP ports in the given direction,
+// using the given reject type (ICMP port-unreachable messages by default)
+func (s *Service) RejectUDP(ctx context.Context, ports Ports, dir Direction, with string, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionReject, RejectWith: with, RuleOptions: opts}))
+}
+
+// DropUDP silently denies all traffic on the given UDP ports in the given direction
+func (s *Service) DropUDP(ctx context.Context, ports Ports, dir Direction, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionDrop, RuleOptions: opts}))
+}
+
+// AcceptUDP allow all traffic on the given UDP ports in the given direction
+func (s *Service) AcceptUDP(ctx context.Context, ports Ports, dir Direction) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionAccept}))
+}
+
+// RejectAllFrom actively denies all traffic coming from the given IP address or CIDR range on the given
+// input interface, in the given direction, using the given reject type (optional)
+func (s *Service) RejectAllFrom(ctx context.Context, ip, intf string, dir Direction, with string, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, InInterface: intf, Direction: dir, Action: ActionReject, RejectWith: with, RuleOptions: opts}))
+}
+
+// DropAllFrom silently denies all traffic coming from the given IP address or CIDR range on the given
+// input interface, in the given direction
+func (s *Service) DropAllFrom(ctx context.Context, ip, intf string, dir Direction, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, InInterface: intf, Direction: dir, Action: ActionDrop, RuleOptions: opts}))
+}
+
+// AcceptAllFrom allow all traffic coming from the given IP address or CIDR range on the given
+// input interface, in the given direction
+func (s *Service) AcceptAllFrom(ctx context.Context, ip, intf string, dir Direction) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, InInterface: intf, Direction: dir, Action: ActionAccept}))
+}
+
+// RejectAllTo actively denies all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction, using the given reject type (optional)
+func (s *Service) RejectAllTo(ctx context.Context, ip, intf string, dir Direction, with string, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionReject, RejectWith: with, RuleOptions: opts}))
+}
+
+// DropAllTo silently denies all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction
+func (s *Service) DropAllTo(ctx context.Context, ip, intf string, dir Direction, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionDrop, RuleOptions: opts}))
+}
+
+// AcceptAllTo allow all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction
+func (s *Service) AcceptAllTo(ctx context.Context, ip, intf string, dir Direction) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionAccept}))
+}
+
+// LossTCP silently denies the given percentage of traffic on the given TCP ports in the given direction
+func (s *Service) LossTCP(ctx context.Context, ports Ports, dir Direction, percent float64, mode LossMode, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionLoss, Percent: percent, Mode: mode, RuleOptions: opts}))
+}
+
+// LossUDP silently denies the given percentage of traffic on the given UDP ports in the given direction
+func (s *Service) LossUDP(ctx context.Context, ports Ports, dir Direction, percent float64, mode LossMode, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionLoss, Percent: percent, Mode: mode, RuleOptions: opts}))
+}
+
+// LossAllFrom silently denies the given percentage of traffic coming from the given IP address or CIDR range on the given
+// input interface, in the given direction
+func (s *Service) LossAllFrom(ctx context.Context, ip, intf string, dir Direction, percent float64, mode LossMode, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, InInterface: intf, Direction: dir, Action: ActionLoss, Percent: percent, Mode: mode, RuleOptions: opts}))
+}
+
+// DelayTCP delays all traffic sent to the given TCP ports, in the given direction (out|both)
+func (s *Service) DelayTCP(ctx context.Context, ports Ports, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionDelay, Shaping: shaping, RuleOptions: opts}))
+}
+
+// DelayUDP delays all traffic sent to the given UDP ports, in the given direction (out|both)
+func (s *Service) DelayUDP(ctx context.Context, ports Ports, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionDelay, Shaping: shaping, RuleOptions: opts}))
+}
+
+// DelayAllFrom delays all traffic coming from the given IP address or CIDR range that is forwarded by this host,
+// in the given direction (out|both)
+func (s *Service) DelayAllFrom(ctx context.Context, ip string, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, Direction: dir, Action: ActionDelay, Shaping: shaping, RuleOptions: opts}))
+}
+
+// DelayAllTo delays all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction (out|both)
+func (s *Service) DelayAllTo(ctx context.Context, ip, intf string, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionDelay, Shaping: shaping, RuleOptions: opts}))
+}
+
+// ThrottleTCP limits the throughput of all traffic sent to the given TCP ports, in the given direction (out|both)
+func (s *Service) ThrottleTCP(ctx context.Context, ports Ports, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionThrottle, Shaping: shaping, RuleOptions: opts}))
+}
+
+// ThrottleUDP limits the throughput of all traffic sent to the given UDP ports, in the given direction (out|both)
+func (s *Service) ThrottleUDP(ctx context.Context, ports Ports, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionThrottle, Shaping: shaping, RuleOptions: opts}))
+}
+
+// ThrottleAllFrom limits the throughput of all traffic coming from the given IP address or CIDR range that is forwarded
+// by this host, in the given direction (out|both)
+func (s *Service) ThrottleAllFrom(ctx context.Context, ip string, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, Direction: dir, Action: ActionThrottle, Shaping: shaping, RuleOptions: opts}))
+}
+
+// ThrottleAllTo limits the throughput of all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction (out|both)
+func (s *Service) ThrottleAllTo(ctx context.Context, ip, intf string, dir Direction, shaping Shaping, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionThrottle, Shaping: shaping, RuleOptions: opts}))
+}
+
+// CorruptTCP corrupts the given percentage of all traffic sent to the given TCP ports, in the given direction (out|both)
+func (s *Service) CorruptTCP(ctx context.Context, ports Ports, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionCorrupt, Percent: percent, RuleOptions: opts}))
+}
+
+// CorruptUDP corrupts the given percentage of all traffic sent to the given UDP ports, in the given direction (out|both)
+func (s *Service) CorruptUDP(ctx context.Context, ports Ports, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionCorrupt, Percent: percent, RuleOptions: opts}))
+}
+
+// CorruptAllFrom corrupts the given percentage of all traffic coming from the given IP address or CIDR range that is forwarded
+// by this host, in the given direction (out|both)
+func (s *Service) CorruptAllFrom(ctx context.Context, ip string, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, Direction: dir, Action: ActionCorrupt, Percent: percent, RuleOptions: opts}))
+}
+
+// CorruptAllTo corrupts the given percentage of all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction (out|both)
+func (s *Service) CorruptAllTo(ctx context.Context, ip, intf string, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionCorrupt, Percent: percent, RuleOptions: opts}))
+}
+
+// DuplicateTCP duplicates the given percentage of all traffic sent to the given TCP ports, in the given direction (out|both)
+func (s *Service) DuplicateTCP(ctx context.Context, ports Ports, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionDuplicate, Percent: percent, RuleOptions: opts}))
+}
+
+// DuplicateUDP duplicates the given percentage of all traffic sent to the given UDP ports, in the given direction (out|both)
+func (s *Service) DuplicateUDP(ctx context.Context, ports Ports, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionDuplicate, Percent: percent, RuleOptions: opts}))
+}
+
+// DuplicateAllFrom duplicates the given percentage of all traffic coming from the given IP address or CIDR range that is forwarded
+// by this host, in the given direction (out|both)
+func (s *Service) DuplicateAllFrom(ctx context.Context, ip string, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, Direction: dir, Action: ActionDuplicate, Percent: percent, RuleOptions: opts}))
+}
+
+// DuplicateAllTo duplicates the given percentage of all traffic going to the given IP address or CIDR range on the given
+// output interface, in the given direction (out|both)
+func (s *Service) DuplicateAllTo(ctx context.Context, ip, intf string, dir Direction, percent float64, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionDuplicate, Percent: percent, RuleOptions: opts}))
+}
+
+// ReorderTCP sends the given percentage of all traffic sent to the given TCP ports ahead of the others,
+// which are delayed by the given delay, in the given direction (out|both)
+func (s *Service) ReorderTCP(ctx context.Context, ports Ports, dir Direction, percent float64, delay Duration, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "tcp", DestinationPorts: ports, Direction: dir, Action: ActionReorder, Percent: percent, Shaping: Shaping{Delay: delay}, RuleOptions: opts}))
+}
+
+// ReorderUDP sends the given percentage of all traffic sent to the given UDP ports ahead of the others,
+// which are delayed by the given delay, in the given direction (out|both)
+func (s *Service) ReorderUDP(ctx context.Context, ports Ports, dir Direction, percent float64, delay Duration, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Protocol: "udp", DestinationPorts: ports, Direction: dir, Action: ActionReorder, Percent: percent, Shaping: Shaping{Delay: delay}, RuleOptions: opts}))
+}
+
+// ReorderAllFrom sends the given percentage of all traffic coming from the given IP address or CIDR range that is forwarded
+// by this host ahead of the others,
+// which are delayed by the given delay, in the given direction (out|both)
+func (s *Service) ReorderAllFrom(ctx context.Context, ip string, dir Direction, percent float64, delay Duration, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Source: ip, Direction: dir, Action: ActionReorder, Percent: percent, Shaping: Shaping{Delay: delay}, RuleOptions: opts}))
+}
+
+// ReorderAllTo sends the given percentage of all traffic going to the given IP address or CIDR range on the given
+// output interface ahead of the others,
+// which are delayed by the given delay, in the given direction (out|both)
+func (s *Service) ReorderAllTo(ctx context.Context, ip, intf string, dir Direction, percent float64, delay Duration, opts RuleOptions) error {
+	return maskAny(s.ApplyRule(ctx, Rule{Destination: ip, OutInterface: intf, Direction: dir, Action: ActionReorder, Percent: percent, Shaping: Shaping{Delay: delay}, RuleOptions: opts}))
+}
+
+// ApplyRule applies the given rule.
+// A reject, drop, loss or shaping rule replaces the existing rules with the same match that it covers
+// (same direction, or any direction if the rule has direction both),
+// an accept rule removes these rules.
+// Failing operations are retried until the given context is done.
+func (s *Service) ApplyRule(ctx context.Context, rule Rule) error {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	return maskAny(s.applyRule(ctx, rule))
+}
+
+// applyRule applies the given rule.
+// The mutation mutex must be held.
+func (s *Service) applyRule(ctx context.Context, rule Rule) error {
+	return maskAny(s.applyRules(ctx, []Rule{rule}))
+}
+
+// ApplyRules applies the given rules, in the given order, in a single transaction per backend.
+// Either all rules are applied, or none.
+// Failing operations are retried until the given context is done.
+func (s *Service) ApplyRules(ctx context.Context, rules []Rule) error {
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	return maskAny(s.applyRules(ctx, rules))
+}
+
+// applyRules applies the given rules in a single transaction per backend.
+// The mutation mutex must be held.
+func (s *Service) applyRules(ctx context.Context, rules []Rule) error {
+	normalized := make([]Rule, 0, len(rules))
+	families := make([]Family, 0, len(rules))
+	for i, rule := range rules {
+		rule, family, err := rule.normalize()
+		if err != nil {
+			if len(rules) > 1 && IsValidation(err) {
+				return validationErrorf("Rule %d: %v", i+1, err)
+			}
 			return maskAny(err)
 		}
-		ruleSpec := createSourceRuleSpec(ip, intf, "REJECT")
-		if found, err := s.client.Exists(filterTable, s.chainName, ruleSpec...); err != nil {
-			s.Logger.Errorf("Failed to check existance of rulespec %q: %v", ruleSpec, err)
-			return maskAny(err)
-		} else if !found {
-			s.Logger.Infof("Denying traffic from IP %s on %s", ip, intf)
-			if err := s.client.Insert(filterTable, s.chainName, 1, ruleSpec...); err != nil {
-				s.Logger.Errorf("Failed to deny traffic from IP %s on %s: %v", ip, intf, err)
-				return maskAny(err)
-			}
+		if rule.Lease != "" && rule.Action != ActionAccept && !s.hasLease(rule.Lease) {
+			return validationErrorf("Lease '%s' not found", rule.Lease)
 		}
-		return nil
+		normalized = append(normalized, rule)
+		families = append(families, family)
 	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
+
+	plan, err := s.planRules(normalized)
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := s.applyShaping(ctx, plan); err != nil {
 		return maskAny(err)
 	}
-	return nil
-}
 
-// DropAllFrom silently denies all traffic coming from the given IP address on the given interface
-func (s *Service) DropAllFrom(ip, intf string) error {
-	op := func() error {
-		ruleBuilder := func(action string) []string { return createSourceRuleSpec(ip, intf, action) }
-		if err := s.removeRuleSpecs(ruleBuilder, "REJECT"); err != nil {
-			return maskAny(err)
+	var applied []*ruleBatch
+	for _, c := range s.clients {
+		var batch *ruleBatch
+		op := func() error {
+			batch = newRuleBatch(c)
+			for i, rule := range normalized {
+				if c.family&families[i] == 0 {
+					continue
+				}
+				if err := s.addRule(batch, rule, plan.replaced[i], plan.classes[i]); err != nil {
+					return maskAny(err)
+				}
+			}
+			return maskAny(c.ApplyBatch(batch.changes))
 		}
-		ruleSpec := createSourceRuleSpec(ip, intf, "DROP")
-		s.Logger.Infof("Denying traffic from IP %s on %s", ip, intf)
-		if found, err := s.client.Exists(filterTable, s.chainName, ruleSpec...); err != nil {
-			s.Logger.Errorf("Failed to check existance of rulespec %q: %v", ruleSpec, err)
+		if err := s.retry(ctx, op); err != nil {
+			s.Logger.Errorf("Failed to apply %d %s rules: %v", len(normalized), c.family, err)
+			s.rollback(applied)
+			s.undoShaping(plan.set)
 			return maskAny(err)
-		} else if !found {
-			if err := s.client.Insert(filterTable, s.chainName, 1, ruleSpec...); err != nil {
-				s.Logger.Errorf("Failed to deny traffic from IP %s on %s: %v", ip, intf, err)
-				return maskAny(err)
-			}
 		}
-		return nil
-	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
-		return maskAny(err)
+		applied = append(applied, batch)
 	}
-	return nil
-}
-
-// AcceptAllFrom allow all traffic coming from the given IP address on the given interface
-func (s *Service) AcceptAllFrom(ip, intf string) error {
-	op := func() error {
-		s.Logger.Infof("Accepting traffic from IP %s on %s", ip, intf)
-		ruleBuilder := func(action string) []string { return createSourceRuleSpec(ip, intf, action) }
-		if err := s.removeRuleSpecs(ruleBuilder, "REJECT", "DROP"); err != nil {
+	s.removeShapingClasses(plan)
+	for i, rule := range normalized {
+		if err := s.registerRule(rule, plan.replaced[i], plan.classes[i]); err != nil {
 			return maskAny(err)
 		}
-		return nil
-	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
-		return maskAny(err)
 	}
+	s.saveState()
 	return nil
 }
 
-// Rules returns a list of all rules injected by this service.
-func (s *Service) Rules() ([]string, error) {
-	var result []string
-	op := func() error {
-		list, err := s.client.List(filterTable, s.chainName)
-		if err != nil {
-			return maskAny(err)
+// forEachClient runs the given operation (with retries) for every client that handles
+// one of the given address families.
+func (s *Service) forEachClient(ctx context.Context, family Family, op func(c client) error) error {
+	for _, c := range s.clients {
+		if c.family&family == 0 {
+			continue
 		}
-		result = list
-		return nil
-	}
-	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
-		return nil, maskAny(err)
-	}
-	return result, nil
-}
-
-// removeRuleSpecs removes all rules with given actions to given port.
-func (s *Service) removeRuleSpecs(ruleBuilder func(action string) []string, actions ...string) error {
-	for _, action := range actions {
-		ruleSpec := ruleBuilder(action)
-		if found, err := s.client.Exists(filterTable, s.chainName, ruleSpec...); err != nil {
-			s.Logger.Errorf("Failed to check existance of rulespec %q: %v", ruleSpec, err)
+		c := c
+		if err := s.retry(ctx, func() error { return op(c) }); err != nil {
 			return maskAny(err)
-		} else if found {
-			if err := s.client.Delete(filterTable, s.chainName, ruleSpec...); err != nil {
-				s.Logger.Errorf("Failed to remove rulespec %q: %v", ruleSpec, err)
-				return maskAny(err)
-			}
 		}
 	}
 	return nil
 }
 
-func createPortRuleSpec(port int, action string) []string {
-	return []string{
-		"-p", "tcp",
-		"-m", "tcp", "--dport", strconv.Itoa(port),
-		"-j", action,
-	}
-}
-
-func createSourceRuleSpec(ip, intf string, action string) []string {
-	var spec []string
-	if ip != "" {
-		spec = append(spec, "-s", fmt.Sprintf("%s/32", ip))
-	}
-	if intf != "" {
-		spec = append(spec, "-i", intf)
-	}
-	return append(spec,
-		"-j", action,
-	)
-}
-
 func isExitCodeError(err error, exitCode int) bool {
 	eerr, ok := errors.Cause(err).(*iptables.Error)
 	return ok && eerr.ExitStatus() == exitCode
@@ -0,0 +1,652 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+// newTestService creates an initialized service that uses a memory backend.
+func newTestService(t *testing.T) (*Service, *MemoryBackend) {
+	backend := NewMemoryBackend()
+	return newTestServiceWithBackend(t, backend), backend
+}
+
+// newTestServiceWithBackend creates an initialized service that uses the given backend.
+func newTestServiceWithBackend(t *testing.T, backend Backend) *Service {
+	return newTestServiceWithConfig(t, ServiceConfig{}, backend)
+}
+
+// newTestServiceWithConfig creates an initialized service with given config that uses the given backend.
+func newTestServiceWithConfig(t *testing.T, config ServiceConfig, backend Backend) *Service {
+	log := logging.MustGetLogger("test")
+	logging.SetLevel(logging.WARNING, "test")
+	s, err := NewService(config, ServiceDependencies{
+		Logger:  log,
+		Backend: backend,
+	})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	if err := s.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	return s
+}
+
+// failingBackend is a memory backend whose batches fail while fail is set.
+type failingBackend struct {
+	*MemoryBackend
+	fail bool
+}
+
+// ApplyBatch applies the given changes, unless the backend is set to fail.
+func (b *failingBackend) ApplyBatch(changes []RuleChange) error {
+	if b.fail {
+		return permanentErrorf("Batch failed")
+	}
+	return maskAny(b.MemoryBackend.ApplyBatch(changes))
+}
+
+// listRules returns the rulespecs of the rules in the given table/chain, except for the final RETURN rule.
+func listRules(t *testing.T, backend Backend, table, chain string) []string {
+	list, err := backend.List(table, chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	prefix := "-A " + chain + " "
+	var result []string
+	for _, line := range list {
+		if strings.HasPrefix(line, prefix) && line != prefix+"-j RETURN" {
+			result = append(result, strings.TrimPrefix(line, prefix))
+		}
+	}
+	return result
+}
+
+// expectRules checks that the given table/chain contains exactly the given rulespecs (in order).
+func expectRules(t *testing.T, backend Backend, table, chain string, expected ...string) {
+	if rules := listRules(t, backend, table, chain); strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected rules %q in %s/%s, got %q", expected, table, chain, rules)
+	}
+}
+
+// TestDropRejectAccept checks the chains & rules created by Initialize, the basic drop, reject & accept rules
+// and Cleanup.
+func TestDropRejectAccept(t *testing.T) {
+	s, backend := newTestService(t)
+	ctx := context.Background()
+	in, fwd, out := inputHook.chainName(s.chainName), forwardHook.chainName(s.chainName), outputHook.chainName(s.chainName)
+
+	// Every built-in chain jumps to the chain of the service first
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.builtin, "-j "+h.chainName(s.chainName))
+		expectRules(t, backend, h.table, h.chainName(s.chainName))
+	}
+
+	if err := s.DropTCP(ctx, Ports{{80, 80}}, DirectionBoth, RuleOptions{}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	for _, chain := range []string{in, fwd, out} {
+		expectRules(t, backend, filterTable, chain, "-p tcp -m tcp --dport 80 -j DROP")
+	}
+
+	// A reject rule replaces the drop rule
+	if err := s.RejectTCP(ctx, Ports{{80, 80}}, DirectionBoth, "tcp-reset", RuleOptions{}); err != nil {
+		t.Fatalf("RejectTCP failed: %v", err)
+	}
+	for _, chain := range []string{in, fwd, out} {
+		expectRules(t, backend, filterTable, chain, "-p tcp -m tcp --dport 80 -j REJECT --reject-with tcp-reset")
+	}
+
+	if err := s.DropAllFrom(ctx, "10.0.0.5", "eth0", DirectionIn, RuleOptions{}); err != nil {
+		t.Fatalf("DropAllFrom failed: %v", err)
+	}
+	if err := s.RejectAllFrom(ctx, "10.0.0.0/8", "", DirectionOut, "", RuleOptions{}); err != nil {
+		t.Fatalf("RejectAllFrom failed: %v", err)
+	}
+	expectRules(t, backend, filterTable, in,
+		"-s 10.0.0.5/32 -i eth0 -m conntrack --ctdir ORIGINAL -j DROP",
+		"-p tcp -m tcp --dport 80 -j REJECT --reject-with tcp-reset")
+	expectRules(t, backend, filterTable, fwd,
+		"-p tcp -m tcp --dport 80 -j REJECT --reject-with tcp-reset")
+	expectRules(t, backend, filterTable, out,
+		"-s 10.0.0.0/8 -m conntrack --ctdir ORIGINAL -j REJECT",
+		"-p tcp -m tcp --dport 80 -j REJECT --reject-with tcp-reset")
+
+	if err := s.AcceptTCP(ctx, Ports{{80, 80}}, DirectionBoth); err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	if err := s.AcceptAllFrom(ctx, "10.0.0.5", "eth0", DirectionIn); err != nil {
+		t.Fatalf("AcceptAllFrom failed: %v", err)
+	}
+	expectRules(t, backend, filterTable, in)
+	expectRules(t, backend, filterTable, fwd)
+	expectRules(t, backend, filterTable, out, "-s 10.0.0.0/8 -m conntrack --ctdir ORIGINAL -j REJECT")
+	if rules := s.Rules(); len(rules) != 1 || rules[0].Source != "10.0.0.0/8" {
+		t.Errorf("Expected only the reject rule for 10.0.0.0/8, got %+v", rules)
+	}
+
+	// Cleanup removes the chains of the service & the jumps to them
+	if err := s.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	chains, err := backend.ListChains(filterTable)
+	if err != nil {
+		t.Fatalf("ListChains failed: %v", err)
+	}
+	if strings.Join(chains, " ") != strings.Join(builtinChains[filterTable], " ") {
+		t.Errorf("Expected only the built-in chains, got %q", chains)
+	}
+	for _, h := range allHooks {
+		expectRules(t, backend, h.table, h.builtin)
+	}
+}
+
+// TestApplyRulesRollback checks that a batch of rules is rolled back in all backends
+// when it fails in one of them, keeping the rules it would replace.
+func TestApplyRulesRollback(t *testing.T) {
+	ipv4 := NewMemoryBackend()
+	ipv6 := &failingBackend{MemoryBackend: NewMemoryBackend()}
+	s, err := NewService(ServiceConfig{}, ServiceDependencies{
+		Logger:      logging.MustGetLogger("test"),
+		Backend:     ipv4,
+		IPv6Backend: ipv6,
+	})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	if err := s.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	in := inputHook.chainName(s.chainName)
+	if err := s.RejectTCP(ctx, Ports{{80, 80}}, DirectionIn, "", RuleOptions{}); err != nil {
+		t.Fatalf("RejectTCP failed: %v", err)
+	}
+	rules := []Rule{
+		{Protocol: "tcp", DestinationPorts: Ports{{80, 80}}, Direction: DirectionIn, Action: ActionDrop},
+		{Source: "10.0.0.5", Direction: DirectionIn, Action: ActionDrop},
+		{Source: "fd00::1", Direction: DirectionIn, Action: ActionDrop},
+	}
+
+	// The IPv6 batch fails after the IPv4 batch has been applied
+	ipv6.fail = true
+	if err := s.ApplyRules(ctx, rules); err == nil {
+		t.Fatalf("Expected ApplyRules to fail")
+	}
+	reject := "-p tcp -m tcp --dport 80 -m conntrack --ctdir ORIGINAL -j REJECT"
+	expectRules(t, ipv4, filterTable, in, reject)
+	expectRules(t, ipv6, filterTable, in, reject)
+	if list := s.Rules(); len(list) != 1 || list[0].Action != ActionReject {
+		t.Errorf("Expected only the reject rule, got %+v", list)
+	}
+
+	ipv6.fail = false
+	if err := s.ApplyRules(ctx, rules); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	drop := "-p tcp -m tcp --dport 80 -m conntrack --ctdir ORIGINAL -j DROP"
+	expectRules(t, ipv4, filterTable, in, "-s 10.0.0.5/32 -m conntrack --ctdir ORIGINAL -j DROP", drop)
+	expectRules(t, ipv6, filterTable, in, "-s fd00::1/128 -m conntrack --ctdir ORIGINAL -j DROP", drop)
+	if list := s.Rules(); len(list) != 3 {
+		t.Errorf("Expected 3 rules, got %+v", list)
+	}
+}
+
+// TestConcurrentRuleToggling applies drop, reject & accept rules for the same ports from many goroutines
+// (while reconciling concurrently) and checks that the chains match the registry afterwards.
+func TestConcurrentRuleToggling(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	actions := []Action{ActionDrop, ActionReject, ActionAccept}
+	protocols := []string{"tcp", "udp"}
+	ports := []Ports{{{80, 80}}, {{8529, 8539}}}
+
+	const workers = 16
+	const iterations = 200
+	var wg sync.WaitGroup
+	errors := make(chan error, workers*iterations)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < iterations; i++ {
+				rule := Rule{
+					Protocol:         protocols[rnd.Intn(len(protocols))],
+					DestinationPorts: ports[rnd.Intn(len(ports))],
+					Direction:        DirectionIn,
+					Action:           actions[rnd.Intn(len(actions))],
+				}
+				if err := s.ApplyRule(context.Background(), rule); err != nil {
+					errors <- err
+				}
+			}
+		}(int64(w))
+	}
+	stop := make(chan struct{})
+	reconciled := make(chan struct{})
+	go func() {
+		defer close(reconciled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Reconcile()
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-reconciled
+	close(errors)
+	for err := range errors {
+		t.Errorf("ApplyRule failed: %v", err)
+	}
+
+	// Every registered rule must be in the chain exactly once, with the registered action
+	chain := inputHook.chainName(s.chainName)
+	list, err := backend.List(filterTable, chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	for _, protocol := range protocols {
+		for _, p := range ports {
+			match := fmt.Sprintf("-p %s %s ", protocol, strings.Join(p.createMatchSpec(protocol, "d"), " "))
+			var found []string
+			for _, line := range list {
+				if strings.Contains(line, match) {
+					found = append(found, line)
+				}
+			}
+			expected := Rule{Protocol: protocol, DestinationPorts: p, Direction: DirectionIn}
+			var registered *AppliedRule
+			for _, r := range s.Rules() {
+				if r.key() == expected.key() {
+					r := r
+					registered = &r
+				}
+			}
+			switch {
+			case registered == nil && len(found) != 0:
+				t.Errorf("Expected no rule for %s, got %q", expected, found)
+			case registered != nil && len(found) != 1:
+				t.Errorf("Expected exactly 1 %s rule for %s, got %q", registered.Action, expected, found)
+			case registered != nil && !strings.Contains(found[0], "-j "+registered.Action.target()):
+				t.Errorf("Expected %s rule for %s, got %q", registered.Action, expected, found[0])
+			}
+		}
+	}
+
+	// The reconciler must never have seen a half applied rule
+	if events := s.DriftEvents(); len(events) != 0 {
+		t.Errorf("Expected no drift events, got %d: %+v", len(events), events)
+	}
+}
+
+// chainRules returns the rules in the chains of the service for all filter hooks, except the final RETURN rules.
+func chainRules(t *testing.T, s *Service, backend *MemoryBackend) []string {
+	var result []string
+	for _, h := range allHooks {
+		list, err := backend.List(h.table, h.chainName(s.chainName))
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		for _, line := range list {
+			if strings.HasPrefix(line, "-A ") && !strings.HasSuffix(line, "-j RETURN") {
+				result = append(result, line)
+			}
+		}
+	}
+	return result
+}
+
+// TestAcceptRemovesCoveredRules checks that an accept rule with direction both removes the rules of all directions
+// with the same match, from the chains as well as from the registry, so reconciling does not bring them back.
+func TestAcceptRemovesCoveredRules(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	ports := Ports{{80, 80}}
+	if err := s.DropTCP(ctx, ports, DirectionIn, RuleOptions{}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.RejectTCP(ctx, ports, DirectionOut, "", RuleOptions{}); err != nil {
+		t.Fatalf("RejectTCP failed: %v", err)
+	}
+	if rules := chainRules(t, s, backend); len(rules) != 2 {
+		t.Fatalf("Expected 2 rules in the chains, got %q", rules)
+	}
+	if err := s.AcceptTCP(ctx, ports, DirectionBoth); err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	if rules := chainRules(t, s, backend); len(rules) != 0 {
+		t.Errorf("Expected no rules in the chains, got %q", rules)
+	}
+	if rules := s.Rules(); len(rules) != 0 {
+		t.Errorf("Expected no registered rules, got %+v", rules)
+	}
+	s.Reconcile()
+	if rules := chainRules(t, s, backend); len(rules) != 0 {
+		t.Errorf("Expected no rules in the chains after reconciling, got %q", rules)
+	}
+	if events := s.DriftEvents(); len(events) != 0 {
+		t.Errorf("Expected no drift events, got %+v", events)
+	}
+}
+
+// TestAcceptKeepsUncoveredRules checks that removing a rule with direction in (here by label)
+// leaves a rule with the same match and direction both in place.
+func TestAcceptKeepsUncoveredRules(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	ports := Ports{{80, 80}}
+	if err := s.DropTCP(ctx, ports, DirectionBoth, RuleOptions{Labels: Labels{"test": "a"}}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.DropTCP(ctx, ports, DirectionIn, RuleOptions{Labels: Labels{"test": "b"}}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if rules := s.Rules(); len(rules) != 2 {
+		t.Fatalf("Expected 2 registered rules, got %+v", rules)
+	}
+	if n, err := s.RemoveRulesWithLabels(ctx, Labels{"test": "b"}); err != nil {
+		t.Fatalf("RemoveRulesWithLabels failed: %v", err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 removed rule, got %d", n)
+	}
+	rules := s.Rules()
+	if len(rules) != 1 || rules[0].Direction != DirectionBoth || rules[0].Labels["test"] != "a" {
+		t.Fatalf("Expected only the rule with label test=a, got %+v", rules)
+	}
+	// The remaining rule is in the chains of all 3 hooks
+	if list := chainRules(t, s, backend); len(list) != 3 {
+		t.Errorf("Expected 3 rules in the chains, got %q", list)
+	}
+	s.Reconcile()
+	if events := s.DriftEvents(); len(events) != 0 {
+		t.Errorf("Expected no drift events, got %+v", events)
+	}
+}
+
+// TestExpireKeepsOtherRules checks that an expired rule with direction both does not remove
+// the rules with the same match and another direction.
+func TestExpireKeepsOtherRules(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	ports := Ports{{80, 80}}
+	if err := s.DropTCP(ctx, ports, DirectionBoth, RuleOptions{TTL: Duration(10 * time.Millisecond)}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.DropTCP(ctx, ports, DirectionIn, RuleOptions{}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Rules()) == 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rules := s.Rules()
+	if len(rules) != 1 || rules[0].Direction != DirectionIn {
+		t.Fatalf("Expected only the rule with direction in, got %+v", rules)
+	}
+	if list := chainRules(t, s, backend); len(list) != len(DirectionIn.hooks()) {
+		t.Errorf("Expected %d rules in the chains, got %q", len(DirectionIn.hooks()), list)
+	}
+}
+
+// TestRemoveRulesWithLabelsKeepsOtherRules checks that removing the rules with a label does not remove
+// rules with the same match but another label, even if the removed rule has direction both.
+func TestRemoveRulesWithLabelsKeepsOtherRules(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	ports := Ports{{80, 80}}
+	if err := s.DropTCP(ctx, ports, DirectionBoth, RuleOptions{Labels: Labels{"test": "a"}}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.DropTCP(ctx, ports, DirectionIn, RuleOptions{Labels: Labels{"test": "b"}}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if n, err := s.RemoveRulesWithLabels(ctx, Labels{"test": "a"}); err != nil {
+		t.Fatalf("RemoveRulesWithLabels failed: %v", err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 removed rule, got %d", n)
+	}
+	rules := s.Rules()
+	if len(rules) != 1 || rules[0].Direction != DirectionIn || rules[0].Labels["test"] != "b" {
+		t.Fatalf("Expected only the rule with label test=b, got %+v", rules)
+	}
+	if list := chainRules(t, s, backend); len(list) != len(DirectionIn.hooks()) {
+		t.Errorf("Expected %d rules in the chains, got %q", len(DirectionIn.hooks()), list)
+	}
+	if n, err := s.RemoveRulesWithLabels(ctx, Labels{"test": "a"}); err != nil {
+		t.Fatalf("RemoveRulesWithLabels failed: %v", err)
+	} else if n != 0 {
+		t.Errorf("Expected no removed rules, got %d", n)
+	}
+}
+
+// TestExpireExtendedRule checks that the timer of a rule whose TTL has been extended (by re-applying it)
+// does not remove the rule, even if it fires while the rule is re-applied.
+func TestExpireExtendedRule(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	ports := Ports{{80, 80}}
+	if err := s.DropTCP(ctx, ports, DirectionBoth, RuleOptions{TTL: Duration(time.Hour)}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	rules := s.Rules()
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 registered rule, got %+v", rules)
+	}
+	// Re-apply with a longer TTL, then run the callback of the (stopped) original timer
+	if err := s.DropTCP(ctx, ports, DirectionBoth, RuleOptions{TTL: Duration(2 * time.Hour)}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	s.expireRule(rules[0].Rule.key(), rules[0].ID)
+	if rules := s.Rules(); len(rules) != 1 || rules[0].Remaining < Duration(time.Hour) {
+		t.Errorf("Expected the extended rule, got %+v", rules)
+	}
+	if list := chainRules(t, s, backend); len(list) != 3 {
+		t.Errorf("Expected 3 rules in the chains, got %q", list)
+	}
+}
+
+// TestExpireRenewedLease checks that the timer of a lease that has been renewed
+// (while its callback was waiting) does not remove the rules of the lease.
+func TestExpireRenewedLease(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	lease, err := s.CreateLease(Duration(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateLease failed: %v", err)
+	}
+	if err := s.DropTCP(ctx, Ports{{80, 80}}, DirectionBoth, RuleOptions{Lease: lease.ID}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	s.expireLease(lease.ID)
+	if _, err := s.RenewLease(lease.ID); err != nil {
+		t.Errorf("RenewLease failed: %v", err)
+	}
+	if list := chainRules(t, s, backend); len(list) != 3 {
+		t.Errorf("Expected 3 rules in the chains, got %q", list)
+	}
+}
+
+// TestReleaseLeaseKeepsOtherRules checks that releasing a lease only removes the rules created under it,
+// not the rules with the same match (and another direction) that were created without it.
+func TestReleaseLeaseKeepsOtherRules(t *testing.T) {
+	s, backend := newTestService(t)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	lease, err := s.CreateLease(Duration(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateLease failed: %v", err)
+	}
+	ports := Ports{{80, 80}}
+	if err := s.DropTCP(ctx, ports, DirectionBoth, RuleOptions{Lease: lease.ID}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.DropTCP(ctx, ports, DirectionIn, RuleOptions{}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	if err := s.ReleaseLease(ctx, lease.ID); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	rules := s.Rules()
+	if len(rules) != 1 || rules[0].Direction != DirectionIn || rules[0].Lease != "" {
+		t.Fatalf("Expected only the rule without lease, got %+v", rules)
+	}
+	if list := chainRules(t, s, backend); len(list) != len(DirectionIn.hooks()) {
+		t.Errorf("Expected %d rules in the chains, got %q", len(DirectionIn.hooks()), list)
+	}
+}
+
+// TestReleaseLeaseFailure checks that a lease whose rules could not be removed is kept
+// until its rules are removed.
+func TestReleaseLeaseFailure(t *testing.T) {
+	backend := &failingBackend{MemoryBackend: NewMemoryBackend()}
+	s := newTestServiceWithBackend(t, backend)
+	defer s.Cleanup()
+
+	ctx := context.Background()
+	lease, err := s.CreateLease(Duration(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateLease failed: %v", err)
+	}
+	if err := s.DropTCP(ctx, Ports{{80, 80}}, DirectionBoth, RuleOptions{Lease: lease.ID}); err != nil {
+		t.Fatalf("DropTCP failed: %v", err)
+	}
+	backend.fail = true
+	if err := s.ReleaseLease(ctx, lease.ID); err == nil {
+		t.Fatalf("Expected ReleaseLease to fail")
+	}
+	if leases := s.Leases(); len(leases) != 1 {
+		t.Errorf("Expected the lease to be kept, got %+v", leases)
+	}
+	if rules := s.Rules(); len(rules) != 1 {
+		t.Errorf("Expected the rule to be kept, got %+v", rules)
+	}
+	if _, err := s.RenewLease(lease.ID); !IsNotFound(err) {
+		t.Errorf("Expected released lease not to be renewed, got %v", err)
+	}
+	if err := s.DropTCP(ctx, Ports{{81, 81}}, DirectionBoth, RuleOptions{Lease: lease.ID}); !IsValidation(err) {
+		t.Errorf("Expected no new rules under a released lease, got %v", err)
+	}
+
+	// Retry (as done by the timer of the lease)
+	backend.fail = false
+	s.expireLease(lease.ID)
+	if leases := s.Leases(); len(leases) != 0 {
+		t.Errorf("Expected no leases, got %+v", leases)
+	}
+	if rules := s.Rules(); len(rules) != 0 {
+		t.Errorf("Expected no rules, got %+v", rules)
+	}
+	if list := chainRules(t, s, backend.MemoryBackend); len(list) != 0 {
+		t.Errorf("Expected no rules in the chains, got %q", list)
+	}
+}
+
+// TestRestoreStateKeepsFailedRules checks that rules from the state file that cannot be restored
+// are kept in the state file.
+func TestRestoreStateKeepsFailedRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "network-blocker")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	expiresAt := time.Now().Add(time.Hour)
+	initial := state{Rules: []AppliedRule{
+		{ID: "00000001", Rule: Rule{Protocol: "tcp", DestinationPorts: Ports{{80, 80}}, Action: ActionDrop}},
+		// Shaping is not configured, so this rule cannot be restored
+		{ID: "00000002", Rule: Rule{Protocol: "tcp", DestinationPorts: Ports{{81, 81}}, Action: ActionDelay, Shaping: Shaping{Delay: Duration(time.Second)}}, ExpiresAt: &expiresAt},
+	}}
+	data, err := json.Marshal(initial)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := ioutil.WriteFile(stateFile, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	log := logging.MustGetLogger("test")
+	logging.SetLevel(logging.CRITICAL, "test")
+	defer logging.SetLevel(logging.WARNING, "test")
+	s, err := NewService(ServiceConfig{StateFile: stateFile}, ServiceDependencies{
+		Logger:  log,
+		Backend: NewMemoryBackend(),
+	})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	if err := s.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	defer s.Cleanup()
+
+	if rules := s.Rules(); len(rules) != 1 || rules[0].ID != "00000001" {
+		t.Errorf("Expected rule 00000001 to be restored, got %+v", rules)
+	}
+	data, err = ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var saved state
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	var ids []string
+	for _, r := range saved.Rules {
+		ids = append(ids, r.ID)
+		if r.ID == "00000002" && (r.ExpiresAt == nil || !r.ExpiresAt.Equal(expiresAt)) {
+			t.Errorf("Expected rule 00000002 to keep its expiry time, got %v", r.ExpiresAt)
+		}
+	}
+	if strings.Join(ids, ",") != "00000001,00000002" {
+		t.Errorf("Expected both rules in the state file, got %v", ids)
+	}
+}
+
+// TestRulesWithLabelsEmpty checks that an empty rule list is encoded as an empty JSON array.
+func TestRulesWithLabelsEmpty(t *testing.T) {
+	s, _ := newTestService(t)
+	defer s.Cleanup()
+
+	for _, selector := range []Labels{nil, {"test": "a"}} {
+		data, err := json.Marshal(s.RulesWithLabels(selector))
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if string(data) != "[]" {
+			t.Errorf("Expected [] for selector %v, got %s", selector, data)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Shaper is the traffic control mechanism used by a Service to shape traffic marked by its shaping rules.
+// Every shaping rule gets a class of its own, identified by a class number.
+// Packets are assigned to a class by their firewall mark.
+type Shaper interface {
+	// Setup installs the root qdisc that dispatches marked packets to their class.
+	// Existing classes are removed.
+	Setup() error
+	// SetClass shapes packets with given mark using the class with given number,
+	// configured with the given qdisc spec (in tc syntax, e.g. `netem delay 100ms`).
+	// Only the bits of the firewall mark within the shaping mark mask (0x1f000000) are compared with the given mark.
+	SetClass(class int, mark uint32, qdisc []string) error
+	// RemoveClass stops shaping packets of the class with given number.
+	RemoveClass(class int, mark uint32) error
+	// Teardown removes the root qdisc installed by Setup, including all classes.
+	Teardown() error
+}
+
+const (
+	// tcRootHandle is the handle of the root qdisc, used to recognize it
+	tcRootHandle = "4e42:"
+	// tcBands is the number of bands of the root qdisc.
+	// The first 3 bands are used by unmarked traffic, the others by shaping rules.
+	tcBands = 16
+)
+
+// tcShaper is a Shaper that uses the tc command to shape traffic sent via a single device.
+// It installs a prio qdisc as root qdisc of the device, with one band for each shaping rule.
+type tcShaper struct {
+	path   string
+	device string
+}
+
+// NewTCShaper creates a Shaper that uses the tc command to shape traffic sent via the given device.
+func NewTCShaper(device string) (Shaper, error) {
+	path, err := exec.LookPath("tc")
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return &tcShaper{
+		path:   path,
+		device: device,
+	}, nil
+}
+
+// Setup installs the root qdisc that dispatches marked packets to their class.
+// Unmarked packets are prioritized like they are by the default qdisc.
+func (t *tcShaper) Setup() error {
+	return maskAny(t.run("qdisc", "replace", "dev", t.device, "root", "handle", tcRootHandle, "prio",
+		"bands", fmt.Sprintf("%d", tcBands), "priomap", "1", "2", "2", "2", "1", "2", "0", "0", "1", "1", "1", "1", "1", "1", "1", "1"))
+}
+
+// SetClass shapes packets with given mark using the class with given number.
+func (t *tcShaper) SetClass(class int, mark uint32, qdisc []string) error {
+	if err := t.run(append([]string{"qdisc", "replace", "dev", t.device, "parent", tcClassID(class)}, qdisc...)...); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(t.run("filter", "replace", "dev", t.device, "parent", tcRootHandle, "protocol", "all",
+		"prio", "1", "handle", tcFilterHandle(mark), "fw", "flowid", tcClassID(class)))
+}
+
+// RemoveClass stops shaping packets of the class with given number.
+func (t *tcShaper) RemoveClass(class int, mark uint32) error {
+	if err := t.run("filter", "del", "dev", t.device, "parent", tcRootHandle, "protocol", "all",
+		"prio", "1", "handle", tcFilterHandle(mark), "fw"); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(t.run("qdisc", "del", "dev", t.device, "parent", tcClassID(class)))
+}
+
+// Teardown removes the root qdisc, if it has been installed by a shaper.
+// The device falls back to its default qdisc.
+func (t *tcShaper) Teardown() error {
+	output, err := t.output("qdisc", "show", "dev", t.device, "root")
+	if err != nil {
+		return maskAny(err)
+	}
+	if !strings.Contains(string(output), "prio "+tcRootHandle) {
+		return nil
+	}
+	return maskAny(t.run("qdisc", "del", "dev", t.device, "root"))
+}
+
+// tcClassID returns the ID of the class with given number (of the root qdisc).
+func tcClassID(class int) string {
+	return fmt.Sprintf("%s%x", tcRootHandle, class)
+}
+
+// tcFilterHandle returns the handle of the fw filter that matches packets with given mark,
+// comparing only the bits within the shaping mark mask.
+func tcFilterHandle(mark uint32) string {
+	return fmt.Sprintf("0x%x/0x%x", mark, shapingMarkMask)
+}
+
+// run executes the given tc command.
+func (t *tcShaper) run(args ...string) error {
+	_, err := t.output(args...)
+	return maskAny(err)
+}
+
+// output executes the given tc command and returns its standard output.
+func (t *tcShaper) output(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(t.path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "busy") {
+			return nil, maskAny(fmt.Errorf("tc %s failed: %v: %s", strings.Join(args, " "), err, msg))
+		}
+		// tc fails immediately on invalid parameters, missing devices or modules, retrying does not help
+		return nil, permanentErrorf("tc %s failed: %v: %s", strings.Join(args, " "), err, msg)
+	}
+	return stdout.Bytes(), nil
+}
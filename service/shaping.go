@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// firstShapingClass & lastShapingClass are the classes of the root qdisc used by shaping rules
+	// (the classes before them are used by unmarked traffic).
+	firstShapingClass = 4
+	lastShapingClass  = tcBands
+	// shapingMarkMask contains the bits of the firewall mark used to mark the packets of shaping rules.
+	// The other bits are left untouched, since they may be used by other tools (e.g. kube-proxy uses 0x4000 & 0x8000).
+	shapingMarkMask = 0x1f000000
+	// shapingMarkShift is the position of the class number within the firewall mark
+	shapingMarkShift = 24
+)
+
+// Shaping contains the parameters of shaping actions.
+// Shaping actions apply to traffic sent by this host (or forwarded by it) only.
+type Shaping struct {
+	// Delay added to matching packets (delay action), or to the packets that are not reordered
+	// (reorder action, defaults to 10ms)
+	Delay Duration `json:"delay,omitempty"`
+	// Random variation of the delay (delay action)
+	Jitter Duration `json:"jitter,omitempty"`
+	// Maximum throughput of matching traffic, in tc syntax, e.g. 1mbit (throttle action)
+	Rate string `json:"rate,omitempty"`
+	// Size of the token bucket, in tc syntax, e.g. 32kb (throttle action, defaults to 32kb)
+	Burst string `json:"burst,omitempty"`
+}
+
+const (
+	// defaultBurst is the size of the token bucket of a throttle rule without burst
+	defaultBurst = "32kb"
+	// tbfLatency is the maximum time a packet of a throttle rule waits for tokens before it is dropped
+	tbfLatency = "400ms"
+	// defaultReorderDelay is the delay of the packets that are not reordered by a reorder rule without delay
+	defaultReorderDelay = Duration(10 * time.Millisecond)
+)
+
+var (
+	// shapingParams lists the shaping parameters supported by each action
+	shapingParams = map[Action][]string{
+		ActionDelay:     {"delay", "jitter"},
+		ActionThrottle:  {"rate", "burst"},
+		ActionCorrupt:   nil,
+		ActionDuplicate: nil,
+		ActionReorder:   {"delay"},
+	}
+	tcRatePattern = regexp.MustCompile(`^(?i)[0-9]+(\.[0-9]+)?(bit|kbit|mbit|gbit|tbit|bps|kbps|mbps|gbps|tbps)?$`)
+	tcSizePattern = regexp.MustCompile(`^(?i)[0-9]+(b|k|kb|m|mb|g|gb|kbit|mbit|gbit)?$`)
+)
+
+// isShaping returns true if the action shapes matching traffic, instead of accepting or denying it.
+func (a Action) isShaping() bool {
+	_, found := shapingParams[a]
+	return found
+}
+
+// params returns the names of the shaping parameters that are set.
+func (sh Shaping) params() []string {
+	var result []string
+	if sh.Delay != 0 {
+		result = append(result, "delay")
+	}
+	if sh.Jitter != 0 {
+		result = append(result, "jitter")
+	}
+	if sh.Rate != "" {
+		result = append(result, "rate")
+	}
+	if sh.Burst != "" {
+		result = append(result, "burst")
+	}
+	return result
+}
+
+// validateShaping returns an error if the shaping parameters do not fit the action of the rule,
+// and fills in the defaults of shaping parameters.
+func (r *Rule) validateShaping() error {
+	for _, param := range r.Shaping.params() {
+		if !containsString(shapingParams[r.Action], param) {
+			return validationErrorf("Parameter '%s' is not supported by action '%s'", param, r.Action)
+		}
+	}
+	if !r.Action.isShaping() {
+		return nil
+	}
+	if r.Direction == DirectionIn {
+		return validationErrorf("Action '%s' only applies to outgoing traffic (expected direction out|both)", r.Action)
+	}
+	if r.InInterface != "" {
+		return validationErrorf("Action '%s' cannot match the input interface", r.Action)
+	}
+	switch r.Action {
+	case ActionDelay:
+		if r.Delay <= 0 {
+			return validationErrorf("Action '%s' requires a delay", r.Action)
+		}
+	case ActionThrottle:
+		if !tcRatePattern.MatchString(r.Rate) {
+			return validationErrorf("Action '%s' requires a rate such as 1mbit, got '%s'", r.Action, r.Rate)
+		}
+		if r.Burst == "" {
+			r.Burst = defaultBurst
+		} else if !tcSizePattern.MatchString(r.Burst) {
+			return validationErrorf("Invalid burst '%s' (expected a size such as 32kb)", r.Burst)
+		}
+	case ActionReorder:
+		if r.Delay == 0 {
+			r.Delay = defaultReorderDelay
+		}
+	}
+	return nil
+}
+
+// createQdiscSpec returns the tc arguments of the qdisc that shapes the traffic of the rule.
+func (r Rule) createQdiscSpec() []string {
+	switch r.Action {
+	case ActionDelay:
+		spec := []string{"netem", "delay", tcTime(r.Delay)}
+		if r.Jitter > 0 {
+			spec = append(spec, tcTime(r.Jitter))
+		}
+		return spec
+	case ActionThrottle:
+		return []string{"tbf", "rate", r.Rate, "burst", r.Burst, "latency", tbfLatency}
+	case ActionCorrupt:
+		return []string{"netem", "corrupt", tcPercent(r.Percent)}
+	case ActionDuplicate:
+		return []string{"netem", "duplicate", tcPercent(r.Percent)}
+	case ActionReorder:
+		return []string{"netem", "delay", tcTime(r.Delay), "reorder", tcPercent(r.Percent)}
+	default:
+		return nil
+	}
+}
+
+// createMarkSpec returns the rulespec that marks the traffic of the rule for the given traffic control class.
+// Only the bits of the shaping mark mask are changed.
+func (r Rule) createMarkSpec(class int) []string {
+	return append(r.createMatchSpec(), "-j", "MARK", "--set-xmark", fmt.Sprintf("0x%x/0x%x", classMark(class), shapingMarkMask))
+}
+
+// classMark returns the firewall mark (within the shaping mark mask) of packets shaped by the class with given number.
+func classMark(class int) uint32 {
+	return uint32(class) << shapingMarkShift
+}
+
+// tcTime formats the given duration in tc syntax.
+func tcTime(d Duration) string {
+	return fmt.Sprintf("%dus", time.Duration(d)/time.Microsecond)
+}
+
+// tcPercent formats the given percentage in tc syntax.
+func tcPercent(percent float64) string {
+	return strconv.FormatFloat(percent, 'f', -1, 64) + "%"
+}
+
+// hooks returns the hooks of the service.
+// The mark hook is only used when traffic shaping is configured.
+func (s *Service) hooks() []hook {
+	if s.Shaper == nil {
+		return allHooks
+	}
+	return append(append([]hook{}, allHooks...), markHook)
+}
+
+// setClass adds the configuration of the given class to the plan.
+// The given replaced rules are the rules replaced by the rule that uses the class.
+func (p *rulePlan) setClass(class int, qdisc []string, replaced []plannedRule) {
+	for i, c := range p.set {
+		if c.class == class {
+			p.set[i].qdisc = qdisc
+			return
+		}
+	}
+	change := classChange{class: class, qdisc: qdisc}
+	for _, r := range replaced {
+		if r.class == class {
+			change.previous = r.rule.createQdiscSpec()
+		}
+	}
+	p.set = append(p.set, change)
+}
+
+// applyShaping configures the classes of the given plan.
+// On failure, the classes configured so far are restored.
+func (s *Service) applyShaping(ctx context.Context, plan *rulePlan) error {
+	for i, c := range plan.set {
+		c := c
+		op := func() error {
+			return maskAny(s.Shaper.SetClass(c.class, classMark(c.class), c.qdisc))
+		}
+		if err := s.retry(ctx, op); err != nil {
+			s.Logger.Errorf("Failed to configure traffic control class %d: %v", c.class, err)
+			s.undoShaping(plan.set[:i])
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// undoShaping restores the given (configured) classes to their previous configuration.
+// Failures are logged only.
+func (s *Service) undoShaping(changes []classChange) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		var err error
+		if c.previous != nil {
+			err = s.Shaper.SetClass(c.class, classMark(c.class), c.previous)
+		} else {
+			err = s.Shaper.RemoveClass(c.class, classMark(c.class))
+		}
+		if err != nil {
+			s.Logger.Errorf("Failed to restore traffic control class %d: %v", c.class, err)
+		}
+	}
+}
+
+// removeShapingClasses removes the classes that are no longer used once the rules of the given plan are applied.
+// Failures are logged only, since no marked traffic reaches these classes anymore.
+func (s *Service) removeShapingClasses(plan *rulePlan) {
+	for _, class := range plan.removed {
+		if err := s.Shaper.RemoveClass(class, classMark(class)); err != nil {
+			s.Logger.Warningf("Failed to remove traffic control class %d: %v", class, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// state is the content of the state file.
+type state struct {
+	// Rules applied by the service
+	Rules []AppliedRule `json:"rules"`
+	// Leases of the service
+	Leases []Lease `json:"leases,omitempty"`
+	// Rule sets of the service
+	Sets []RuleSet `json:"sets,omitempty"`
+}
+
+// saveState writes all applied rules, leases & rule sets to the state file (if configured).
+// While the state is being restored, nothing is written, since the state file is the only record
+// of the rules that have not been restored yet.
+// Failures are logged, since the rules have already been applied.
+func (s *Service) saveState() {
+	s.mutex.Lock()
+	restoring := s.restoring
+	s.mutex.Unlock()
+	if s.StateFile == "" || restoring {
+		return
+	}
+	s.writeState(s.currentState())
+}
+
+// currentState returns all applied rules, leases & rule sets.
+func (s *Service) currentState() state {
+	return state{Rules: s.Rules(), Leases: s.Leases(), Sets: s.RuleSets()}
+}
+
+// writeState writes the given state to the state file.
+// Failures are logged only.
+func (s *Service) writeState(st state) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		s.Logger.Errorf("Failed to encode state: %v", err)
+		return
+	}
+	// Write to a temporary file first, so the state file is never partially written
+	tmpFile := s.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		s.Logger.Errorf("Failed to write state file '%s': %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, s.StateFile); err != nil {
+		s.Logger.Errorf("Failed to replace state file '%s': %v", s.StateFile, err)
+	}
+}
+
+// restoreState re-applies the rules, leases & rule sets found in the state file (if configured).
+// Rules with a TTL that expired in the meantime are skipped.
+// Leases are restored with a full timeout, since clients could not renew them while the service was down.
+// The state file is written once all rules & sets are restored. Rules & sets that could not be restored
+// are kept in it, so they are restored again on the next start.
+func (s *Service) restoreState() error {
+	if s.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.StateFile)
+	if os.IsNotExist(err) {
+		s.Logger.Infof("State file '%s' not found, starting without rules", s.StateFile)
+		return nil
+	} else if err != nil {
+		return maskAny(err)
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return maskAny(err)
+	}
+
+	s.mutationMutex.Lock()
+	defer s.mutationMutex.Unlock()
+
+	s.mutex.Lock()
+	s.restoring = true
+	for _, l := range st.Leases {
+		lease := &Lease{
+			ID:      l.ID,
+			Timeout: l.Timeout,
+		}
+		s.leases[lease.ID] = lease
+		s.renewLease(lease)
+	}
+	s.mutex.Unlock()
+
+	now := time.Now()
+	restored := 0
+	var failedRules []AppliedRule
+	var failedSets []RuleSet
+	for _, r := range st.Rules {
+		rule, _, err := r.Rule.normalize()
+		if err != nil {
+			s.Logger.Warningf("Skipping invalid rule %s from state file: %v", r.ID, err)
+			failedRules = append(failedRules, r)
+			continue
+		}
+		if r.ExpiresAt != nil {
+			remaining := r.ExpiresAt.Sub(now)
+			if remaining <= 0 {
+				s.Logger.Infof("Skipping rule %s (%s) from state file, its TTL has expired", r.ID, rule)
+				continue
+			}
+			rule.TTL = Duration(remaining)
+		}
+		// Register the rule upfront, so it keeps its ID & creation time
+		key := rule.key()
+		s.mutex.Lock()
+		s.rules[key] = &AppliedRule{
+			ID:        r.ID,
+			Rule:      rule,
+			CreatedAt: r.CreatedAt,
+		}
+		s.mutex.Unlock()
+		if err := s.applyRule(context.Background(), rule); err != nil {
+			s.Logger.Warningf("Failed to restore rule %s (%s): %v", r.ID, rule, err)
+			s.mutex.Lock()
+			delete(s.rules, key)
+			s.mutex.Unlock()
+			failedRules = append(failedRules, r)
+			continue
+		}
+		restored++
+	}
+	for _, set := range st.Sets {
+		if err := s.putRuleSet(context.Background(), set.Name, set.Rules, set.Active); err != nil {
+			s.Logger.Warningf("Failed to restore rule set '%s': %v", set.Name, err)
+			failedSets = append(failedSets, set)
+		}
+	}
+
+	s.mutex.Lock()
+	s.restoring = false
+	s.mutex.Unlock()
+	current := s.currentState()
+	current.Rules = append(current.Rules, failedRules...)
+	current.Sets = append(current.Sets, failedSets...)
+	s.writeState(current)
+
+	s.Logger.Infof("Restored %d rules, %d leases and %d rule sets from '%s'", restored, len(st.Leases), len(st.Sets)-len(failedSets), s.StateFile)
+	if len(failedRules) > 0 || len(failedSets) > 0 {
+		s.Logger.Warningf("Failed to restore %d rules and %d rule sets, they are kept in '%s'", len(failedRules), len(failedSets), s.StateFile)
+	}
+	return nil
+}